@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,6 +15,11 @@ import (
 
 var blockStartingMagic = []byte{144, 53, 207, 44, 57, 127, 48, 142}
 
+// Blocks of partitions created since blocks are tagged start with taggedBlockMagic instead.
+// After the header they store their position in the partition and a MAC of the position and the data,
+// so damaged data is detected (see Partition.Scrub).
+var taggedBlockMagic = []byte{61, 218, 9, 170, 114, 35, 201, 88}
+
 const ( //in bytes
 	ivOffset = 0
 	ivSize   = 16
@@ -25,7 +32,20 @@ const ( //in bytes
 
 	dataOffset = nextBlockIDOffset + blockIDSize //This is the offset where the actual data is stored
 
-	MinBlockSize = dataOffset //At least one byte per block
+	blockIndexOffset = dataOffset //Tagged blocks only, encrypted like the data
+	blockIndexSize   = 8
+	blockCopiesShift = 48 //The upper bits of the stored index hold the number of copies of a redundant partition
+	blockTagOffset   = blockIndexOffset + blockIndexSize
+	blockTagSize     = 16 //Zero while the data was never written
+	taggedDataOffset = blockTagOffset + blockTagSize
+
+	MinBlockSize = taggedDataOffset //At least one byte per block
+)
+
+const (
+	blockRefNumBits = 48 //The upper bits of a stored block id hold the id of the disk the block is on
+	blockRefNumMask = 1<<blockRefNumBits - 1
+	maxDiskID       = 1<<(64-blockRefNumBits) - 1
 )
 
 type Block struct {
@@ -37,24 +57,37 @@ type Block struct {
 	num       int64
 	nextBlock int64
 
-	blockCipher cipher.Block
-	iv          []byte
+	blockCipher  cipher.Block
+	headerCipher cipher.Block //Set if the header is still encrypted with another key than the data
+	iv           []byte
+
+	key    []byte
+	tagged bool  //See taggedBlockMagic
+	index  int64 //Position in the partition, set by the partition
+	copies int   //Number of copies of a redundant partition, 0 otherwise
 }
 
 func NewBlock(d *Disk, key []byte, off, num, size int64) (*Block, error) {
-	if size < MinBlockSize {
-		return nil, fmt.Errorf("Block size %d too small, must be at least %d", size, MinBlockSize)
+	if size < dataOffset {
+		return nil, fmt.Errorf("Block size %d too small, must be at least %d", size, dataOffset)
 	}
 	bc, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	offset := size*num + off
-	return &Block{Disk: d, offset: offset, num: num, maxOffset: offset + size, size: size, blockCipher: bc}, nil
+	return &Block{Disk: d, offset: offset, num: num, maxOffset: offset + size, size: size, blockCipher: bc, key: key}, nil
 }
 
 func (b *Block) GetDataSize() int64 {
-	return b.size - dataOffset
+	return b.size - b.dataStart()
+}
+
+func (b *Block) dataStart() int64 {
+	if b.tagged {
+		return taggedDataOffset
+	}
+	return dataOffset
 }
 
 func (b *Block) getCTR(off int64) (cipher.Stream, error) {
@@ -65,14 +98,21 @@ func (b *Block) getCTR(off int64) (cipher.Stream, error) {
 	ivCopy := make([]byte, len(b.iv))
 	copy(ivCopy, b.iv)
 	IncrementIV(ivCopy, keyBlock)
-	var blockSize = b.blockCipher.BlockSize()
-	_ = blockSize
-	return cipher.NewCTR(b.blockCipher, ivCopy), nil
+	c := b.blockCipher
+	if b.headerCipher != nil && off < b.offset+dataOffset {
+		c = b.headerCipher
+	}
+	ctr := cipher.NewCTR(c, ivCopy)
+	if fromStart := off % int64(len(b.iv)); fromStart != 0 { //Skip the part of the key stream before off
+		skip := make([]byte, fromStart)
+		ctr.XORKeyStream(skip, skip)
+	}
+	return ctr, nil
 }
 
 func (b *Block) getIV() ([]byte, error) {
 	iv := make([]byte, ivSize)
-	_, err := b.File.ReadAt(iv, b.offset+ivOffset)
+	_, err := b.Storage.ReadAt(iv, b.offset+ivOffset)
 	return iv, err
 }
 
@@ -89,15 +129,27 @@ func (b *Block) initIV() error {
 }
 
 func (b *Block) Validate() error {
+	tagged, err := b.validate()
+	if err == nil && tagged != b.tagged {
+		return errors.New("invalid block")
+	}
+	return err
+}
+
+// validate checks the magic of the block and reports whether it is tagged.
+func (b *Block) validate() (bool, error) {
 	magic := make([]byte, blockMagicSize)
 	_, err := b.readAt(magic, blockMagicOffset)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if bytes.Equal(magic, taggedBlockMagic) {
+		return true, nil
 	}
 	if !bytes.Equal(magic, blockStartingMagic) {
-		return errors.New("invalid block")
+		return false, errors.New("invalid block")
 	}
-	return nil
+	return false, nil
 }
 
 func (b *Block) Write(nextBlockID int64) error {
@@ -108,15 +160,53 @@ func (b *Block) Write(nextBlockID int64) error {
 			return err
 		}
 	}
-	_, err := b.File.WriteAt(b.iv, b.offset+ivOffset)
+	_, err := b.Disk.writeAt(b.iv, b.offset+ivOffset)
 	if err != nil {
 		return fmt.Errorf("error writing iv: %v", err)
 	}
-	_, err = b.writeAt(blockStartingMagic, blockMagicOffset)
+	header := make([]byte, blockMagicSize+blockIDSize) //Written at once so a block never becomes valid with a wrong next block id
+	copy(header, blockStartingMagic)
+	if b.tagged {
+		copy(header, taggedBlockMagic)
+	}
+	binary.LittleEndian.PutUint64(header[blockMagicSize:], uint64(nextBlockID))
+	_, err = b.writeAt(header, blockMagicOffset)
+	if err != nil {
+		return fmt.Errorf("error writing block header: %v", err)
+	}
+	b.nextBlock = nextBlockID
+	return nil
+}
+
+// rekey rewrites the header of the block under another key, keeping the iv and therefore the data intact.
+func (b *Block) rekey(key []byte, nextBlockID int64) (*Block, error) {
+	nb, err := b.withKey(key)
+	if err != nil {
+		return nil, err
+	}
+	nb.headerCipher = nil
+	return nb, nb.Write(nextBlockID)
+}
+
+// withKey returns the block with its data decrypted using key without touching the disk.
+// The header can still be read using the old key.
+func (b *Block) withKey(key []byte) (*Block, error) {
+	if err := b.initIV(); err != nil {
+		return nil, err
+	}
+	nb, err := NewBlock(b.Disk, key, b.offset-b.size*b.num, b.num, b.size)
 	if err != nil {
-		return fmt.Errorf("error writing block magic: %v", err)
+		return nil, err
+	}
+	nb.iv = b.iv
+	nb.tagged = b.tagged
+	nb.index = b.index
+	nb.copies = b.copies
+	nb.headerCipher = b.headerCipher
+	if nb.headerCipher == nil {
+		nb.headerCipher = b.blockCipher
 	}
-	return b.SetNextBlockID(nextBlockID)
+	return nb, nil
 }
 
 func (b *Block) GetNextBlockID() (int64, error) {
@@ -140,6 +230,43 @@ func (b *Block) SetNextBlockID(id int64) error {
 	return nil
 }
 
+// refTo returns the block id b has to store to point to next.
+// Blocks on the same disk are referenced by their number alone, which keeps single disk partitions unchanged.
+func (b *Block) refTo(next *Block) (int64, error) {
+	if next.Disk == b.Disk {
+		return next.num, nil
+	}
+	id, err := next.Disk.GetID()
+	if err != nil {
+		return 0, err
+	}
+	return int64(id)<<blockRefNumBits | next.num, nil
+}
+
+func (b *Block) pointsTo(other *Block) (bool, error) {
+	next, err := b.GetNextBlockID()
+	if err != nil {
+		return false, err
+	}
+	return b.refersTo(next, other)
+}
+
+// refersTo reports whether next, stored in b, references other.
+func (b *Block) refersTo(next int64, other *Block) (bool, error) {
+	if next == -1 || next&blockRefNumMask != other.num {
+		return false, nil
+	}
+	diskID := uint16(uint64(next) >> blockRefNumBits)
+	if diskID == 0 {
+		return other.Disk == b.Disk, nil
+	}
+	otherID, err := other.Disk.GetID()
+	if err != nil {
+		return false, err
+	}
+	return otherID == diskID, nil
+}
+
 func (b *Block) getActualOffsetAndSize(requestedOffset int64, requestedSize int) (int64, int) {
 	actualOff := b.offset + requestedOffset
 	actualSize := requestedSize
@@ -151,22 +278,12 @@ func (b *Block) getActualOffsetAndSize(requestedOffset int64, requestedSize int)
 
 func (b *Block) readAt(p []byte, off int64) (int, error) {
 	actualOffset, actualSize := b.getActualOffsetAndSize(off, len(p))
-	fromStart := actualOffset % int64(b.blockCipher.BlockSize())
-	if fromStart != 0 {
-		newP := make([]byte, actualSize+int(fromStart))
-		_, err := b.readAt(newP, off-fromStart)
-		if err != nil {
-			return 0, err
-		}
-		n := copy(p, newP[fromStart:])
-		return n, nil
-	}
 	ctr, err := b.getCTR(actualOffset)
 	if err != nil {
 		return 0, err
 	}
 	buf := make([]byte, actualSize)
-	_, err = b.File.ReadAt(buf, actualOffset)
+	_, err = b.Storage.ReadAt(buf, actualOffset)
 	if err != nil {
 		return 0, err
 	}
@@ -178,31 +295,18 @@ func (b *Block) readAt(p []byte, off int64) (int, error) {
 }
 
 func (b *Block) ReadAt(p []byte, off int64) (int, error) {
-	return b.readAt(p, dataOffset+off)
+	return b.readAt(p, b.dataStart()+off)
 }
 
 func (b *Block) writeAt(p []byte, off int64) (int, error) {
 	actualOffset, actualSize := b.getActualOffsetAndSize(off, len(p))
-	fromStart := actualOffset % int64(b.blockCipher.BlockSize())
-	if fromStart != 0 {
-		old := make([]byte, fromStart)
-		_, err := b.readAt(old, off-fromStart)
-		if err != nil {
-			return 0, err
-		}
-		newP := make([]byte, actualSize+int(fromStart))
-		copy(newP, old)
-		copy(newP[fromStart:], p)
-		n, err := b.writeAt(newP, off-fromStart)
-		return n - int(fromStart), err
-	}
 	ctr, err := b.getCTR(actualOffset)
 	if err != nil {
 		return 0, err
 	}
 	buf := make([]byte, actualSize)
 	ctr.XORKeyStream(buf, p[:actualSize])
-	n, err := b.File.WriteAt(buf, actualOffset)
+	n, err := b.Disk.writeAt(buf, actualOffset)
 	if err != nil {
 		return n, err
 	}
@@ -212,16 +316,136 @@ func (b *Block) writeAt(p []byte, off int64) (int, error) {
 	return len(p), nil
 }
 
+// WriteAt writes p to the data of the block. Tagged blocks are rewritten as a whole together with the new tag.
 func (b *Block) WriteAt(p []byte, off int64) (int, error) {
-	return b.writeAt(p, off+dataOffset)
+	if !b.tagged {
+		return b.writeAt(p, off+dataOffset)
+	}
+	data := make([]byte, b.GetDataSize())
+	if off < 0 || off > int64(len(data)) {
+		return 0, fmt.Errorf("offset %d outside of the block", off)
+	}
+	n := copy(data[off:], p)
+	if n < len(data) {
+		if _, err := b.readAt(data, taggedDataOffset); err != nil {
+			return 0, err
+		}
+		copy(data[off:], p)
+	}
+	if err := b.writeTagged(data); err != nil {
+		return 0, err
+	}
+	if n != len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// writeTagged replaces the data of a tagged block, writing it at once with the index and the tag.
+func (b *Block) writeTagged(data []byte) error {
+	buf := make([]byte, blockIndexSize+blockTagSize, blockIndexSize+blockTagSize+len(data))
+	binary.LittleEndian.PutUint64(buf, b.storedIndex())
+	copy(buf[blockIndexSize:], b.tag(b.storedIndex(), data))
+	_, err := b.writeAt(append(buf, data...), blockIndexOffset)
+	return err
+}
+
+func (b *Block) tag(stored uint64, data []byte) []byte {
+	mac := hmac.New(sha256.New, deriveKey(b.key, "block tag"))
+	binary.Write(mac, binary.LittleEndian, stored)
+	mac.Write(data)
+	return mac.Sum(nil)[:blockTagSize]
+}
+
+func (b *Block) storedIndex() uint64 {
+	return uint64(b.index) | uint64(b.copies)<<blockCopiesShift
+}
+
+// writeIndex stores the position of a newly allocated block, its data counts as never written.
+func (b *Block) writeIndex(index int64) error {
+	b.index = index
+	if !b.tagged {
+		return nil
+	}
+	buf := make([]byte, blockIndexSize+blockTagSize)
+	binary.LittleEndian.PutUint64(buf, b.storedIndex())
+	_, err := b.writeAt(buf, blockIndexOffset)
+	return err
+}
+
+// setIndex moves the block to another position in its partition, rewriting its tag.
+// Blocks whose data doesn't match their tag only get the new position, so they stay detectably damaged.
+func (b *Block) setIndex(index int64) error {
+	if !b.tagged {
+		b.index = index
+		return nil
+	}
+	stored, tag, data, err := b.readTagged()
+	if err != nil {
+		return err
+	}
+	b.copies = int(stored >> blockCopiesShift)
+	if bytes.Equal(tag, zeroTag) {
+		return b.writeIndex(index)
+	}
+	intact := hmac.Equal(tag, b.tag(stored, data))
+	b.index = index
+	if intact {
+		return b.writeTagged(data)
+	}
+	buf := make([]byte, blockIndexSize)
+	binary.LittleEndian.PutUint64(buf, b.storedIndex())
+	_, err = b.writeAt(buf, blockIndexOffset)
+	return err
+}
+
+var zeroTag = make([]byte, blockTagSize)
+
+// readTagged returns the stored index, tag and data of a tagged block.
+func (b *Block) readTagged() (uint64, []byte, []byte, error) {
+	buf := make([]byte, blockIndexSize+blockTagSize+b.GetDataSize())
+	if _, err := b.readAt(buf, blockIndexOffset); err != nil {
+		return 0, nil, nil, err
+	}
+	return binary.LittleEndian.Uint64(buf), buf[blockIndexSize : blockIndexSize+blockTagSize], buf[blockIndexSize+blockTagSize:], nil
+}
+
+// readIndex returns the position and the number of copies stored in a tagged block and whether its tag matches them.
+// Blocks whose data was never written always match.
+func (b *Block) readIndex() (int64, int, bool, error) {
+	stored, tag, data, err := b.readTagged()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	ok := bytes.Equal(tag, zeroTag) || hmac.Equal(tag, b.tag(stored, data))
+	return int64(stored & (1<<blockCopiesShift - 1)), int(stored >> blockCopiesShift), ok, nil
+}
+
+// checkTag reports whether the data of the block matches its tag and the block is stored for its position.
+// Untagged blocks and blocks whose data was never written always pass.
+func (b *Block) checkTag() (bool, error) {
+	if !b.tagged {
+		return true, nil
+	}
+	index, _, ok, err := b.readIndex()
+	return ok && index == b.index, err
+}
+
+// intact reports whether the block is valid and its data matches its tag.
+func (b *Block) intact() (bool, error) {
+	if b.Validate() != nil {
+		return false, nil
+	}
+	return b.checkTag()
 }
 
 func (b *Block) Delete() error {
-	_, err := b.File.Seek(b.offset, 0)
+	buf := make([]byte, b.size)
+	_, err := rand.Read(buf)
 	if err != nil {
 		return err
 	}
-	_, err = io.CopyN(b.File, rand.Reader, b.size)
+	_, err = b.Disk.writeAt(buf, b.offset)
 	delete(b.Disk.usedBlocks, b.num)
 	return err
 }
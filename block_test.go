@@ -2,7 +2,6 @@ package rubberhose_test
 
 import (
 	"crypto/rand"
-	"os"
 	"strings"
 	"testing"
 
@@ -11,12 +10,10 @@ import (
 )
 
 func TestBlock(t *testing.T) {
-	f, err := os.CreateTemp("", "")
-	require.NoError(t, err)
 	key := make([]byte, 32)
-	_, err = rand.Read(key)
+	_, err := rand.Read(key)
 	require.NoError(t, err)
-	d := rubberhose.NewDiskFromFile(f)
+	d := rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(0))
 	block, err := rubberhose.NewBlock(d, key, 0, 0, rubberhose.MinBlockSize+32)
 	require.NoError(t, err)
 	err = block.Validate()
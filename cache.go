@@ -0,0 +1,237 @@
+package rubberhose
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+type CachePolicy int
+
+const (
+	WriteThrough CachePolicy = iota //Writes go to the disk immediately
+	WriteBack                       //Writes are kept in the cache until the block is evicted or the partition is synced
+)
+
+// DefaultWriteBuffer is the size of the cache used to buffer writes to exposed partitions that have no cache set.
+const DefaultWriteBuffer = 4 << 20
+
+type CacheStats struct {
+	Hits       int64
+	Misses     int64
+	Evictions  int64
+	WriteBacks int64 //Dirty blocks written to the disk
+}
+
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// blockCache keeps the decrypted data of recently used blocks, the least recently used block is evicted first.
+type blockCache struct {
+	sync.Mutex
+	capacity int //In blocks
+	policy   CachePolicy
+	entries  map[int]*list.Element
+	lru      *list.List
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	block int
+	data  []byte
+	dirty bool
+}
+
+// SetCache enables a cache of decrypted blocks using at most budget bytes of memory. A budget of 0 disables the cache.
+// Dirty blocks of the previous cache are written to the disk first.
+func (par *Partition) SetCache(budget int64, policy CachePolicy) error {
+	if budget < 0 {
+		return errors.New("negative cache size")
+	}
+	par.mu.Lock()
+	defer par.mu.Unlock()
+	if err := par.flushCache(); err != nil {
+		return err
+	}
+	capacity := budget / par.blockSize
+	if capacity == 0 {
+		par.cache = nil
+		return nil
+	}
+	par.cache = &blockCache{capacity: int(capacity), policy: policy, entries: map[int]*list.Element{}, lru: list.New()}
+	return nil
+}
+
+func (par *Partition) CacheStats() CacheStats {
+	par.mu.RLock()
+	defer par.mu.RUnlock()
+	if par.cache == nil {
+		return CacheStats{}
+	}
+	par.cache.Lock()
+	defer par.cache.Unlock()
+	return par.cache.stats
+}
+
+func (par *Partition) cachedReadAt(p []byte, off int64) (int, error) {
+	c := par.cache
+	c.Lock()
+	defer c.Unlock()
+	read := 0
+	for len(p) > 0 {
+		i := int(off / par.blockSize)
+		if i >= len(par.blocks) {
+			return read, io.EOF
+		}
+		e, err := par.cacheEntry(i, true)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p, e.data[off%par.blockSize:])
+		p = p[n:]
+		off += int64(n)
+		read += n
+	}
+	return read, nil
+}
+
+func (par *Partition) cachedWriteAt(p []byte, off int64) (int, error) {
+	c := par.cache
+	c.Lock()
+	defer c.Unlock()
+	written := 0
+	for len(p) > 0 {
+		i := int(off / par.blockSize)
+		if i >= len(par.blocks) {
+			return written, io.EOF
+		}
+		blockOff := off % par.blockSize
+		e, err := par.cacheEntry(i, blockOff != 0 || int64(len(p)) < par.blockSize)
+		if err != nil {
+			return written, err
+		}
+		n := copy(e.data[blockOff:], p)
+		e.dirty = true
+		if c.policy == WriteThrough {
+			if err := par.writeBack(e); err != nil {
+				return written, err
+			}
+		}
+		p = p[n:]
+		off += int64(n)
+		written += n
+	}
+	return written, nil
+}
+
+// cacheEntry returns the entry of the i-th block, adding it to the cache if necessary.
+// If load is false the block is about to be overwritten completely and isn't read from the disk.
+func (par *Partition) cacheEntry(i int, load bool) (*cacheEntry, error) {
+	c := par.cache
+	if el, ok := c.entries[i]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(el)
+		return el.Value.(*cacheEntry), nil
+	}
+	c.stats.Misses++
+	e := &cacheEntry{block: i, data: make([]byte, par.blockSize)}
+	if load {
+		if _, err := par.readData(e.data, int64(i)*par.blockSize); err != nil {
+			return nil, err
+		}
+	}
+	for c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		if err := par.writeBack(oldest.Value.(*cacheEntry)); err != nil {
+			return nil, err
+		}
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).block)
+		c.stats.Evictions++
+	}
+	c.entries[i] = c.lru.PushFront(e)
+	return e, nil
+}
+
+func (par *Partition) writeBack(e *cacheEntry) error {
+	if !e.dirty {
+		return nil
+	}
+	if _, err := par.writeData(e.data, int64(e.block)*par.blockSize); err != nil {
+		return err
+	}
+	e.dirty = false
+	if par.cache.policy == WriteBack {
+		par.cache.stats.WriteBacks++
+	}
+	return nil
+}
+
+// flushCache writes all dirty blocks to the disk.
+func (par *Partition) flushCache() error {
+	c := par.cache
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		if err := par.writeBack(el.Value.(*cacheEntry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushRange writes the dirty blocks containing the given range of data to the disk.
+func (par *Partition) flushRange(off, length int64) error {
+	c := par.cache
+	if c == nil || length == 0 {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	for i := int(off / par.blockSize); i <= int((off+length-1)/par.blockSize); i++ {
+		if el, ok := c.entries[i]; ok {
+			if err := par.writeBack(el.Value.(*cacheEntry)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropCache forgets the cached blocks starting with the n-th one without writing them.
+func (par *Partition) dropCache(n int) {
+	c := par.cache
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for i, el := range c.entries {
+		if i >= n {
+			c.lru.Remove(el)
+			delete(c.entries, i)
+		}
+	}
+}
+
+// dropBlock forgets the cached data of the i-th block without writing it.
+func (par *Partition) dropBlock(i int) {
+	c := par.cache
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[i]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, i)
+	}
+}
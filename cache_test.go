@@ -0,0 +1,90 @@
+package rubberhose_test
+
+import (
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	testPass := "test"
+	p, err := d.WritePartition(testPass, 6)
+	require.NoError(t, err)
+	require.NoError(t, p.SetCache(20, rubberhose.WriteBack))
+	testBytes := []byte("Cached for later")
+	writeTestData(t, p, testBytes, 3)
+	requireData(t, p, testBytes, 3)
+	stats := p.CacheStats()
+	require.Equal(t, int64(2), stats.Hits)
+	require.Equal(t, int64(2), stats.Misses)
+	require.Equal(t, 0.5, stats.HitRate())
+
+	other, err := rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	onDisk, err := other.GetPartition(testPass)
+	require.NoError(t, err)
+	readBytes := make([]byte, len(testBytes))
+	_, err = onDisk.ReadAt(readBytes, 3)
+	require.NoError(t, err)
+	require.NotEqual(t, testBytes, readBytes)
+
+	_, err = p.ReadAt(make([]byte, 10), 40) //Evicts the first block
+	require.NoError(t, err)
+	stats = p.CacheStats()
+	require.Equal(t, int64(1), stats.Evictions)
+	require.Equal(t, int64(1), stats.WriteBacks)
+	require.NoError(t, p.Sync())
+	require.Equal(t, int64(2), p.CacheStats().WriteBacks)
+	requireData(t, onDisk, testBytes, 3)
+
+	require.NoError(t, p.SetCache(20, rubberhose.WriteThrough))
+	testBytes = []byte("Written through")
+	writeTestData(t, p, testBytes, 30)
+	_, err = onDisk.ReadAt(readBytes[:len(testBytes)], 30)
+	require.NoError(t, err)
+	require.Equal(t, testBytes, readBytes[:len(testBytes)])
+	require.Zero(t, p.CacheStats().WriteBacks)
+}
+
+func TestFlush(t *testing.T) {
+	testPass := "test"
+	flushed := []byte("Flushed data")
+	fua := []byte("Forced data")
+	for writes := 0; ; writes++ {
+		d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+		p, err := d.WritePartition(testPass, 6)
+		require.NoError(t, err)
+		require.NoError(t, p.SetCache(1000, rubberhose.WriteBack))
+		writeTestData(t, p, flushed, 0)
+		require.NoError(t, p.Sync())
+		for i := 0; i < 10; i++ { //Coalesced into a single write of the block
+			_, err = p.WriteAt([]byte{byte(i)}, int64(50+i))
+			require.NoError(t, err)
+		}
+		_, err = p.WriteAtFUA(fua, 30)
+		require.NoError(t, err)
+		_, err = p.WriteAt([]byte("Overwritten"), 0)
+		require.NoError(t, err)
+
+		crashAfter(d, writes)
+		writeBacks := p.CacheStats().WriteBacks
+		err = p.Sync()
+		reopened, reopenErr := rubberhose.NewDisk(path)
+		require.NoError(t, reopenErr)
+		onDisk, reopenErr := reopened.GetPartition(testPass)
+		require.NoError(t, reopenErr)
+		requireData(t, onDisk, fua, 30)
+		if err != nil {
+			require.Contains(t, err.Error(), errCrash.Error())
+			readBytes := make([]byte, len(flushed))
+			_, err = onDisk.ReadAt(readBytes, 0)
+			require.NoError(t, err)
+			require.Equal(t, flushed[11:], readBytes[11:]) //Only the first 11 bytes were overwritten after the flush
+			continue
+		}
+		require.Equal(t, writeBacks+3, p.CacheStats().WriteBacks)
+		break
+	}
+}
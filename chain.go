@@ -0,0 +1,345 @@
+package rubberhose
+
+import "context"
+
+// Changes to a block chain are made in two phases so that a crash leaves either the old or the new chain:
+// blocks that are about to join or leave the chain are first rewritten under the pending key of the partition,
+// then a single block header write commits the change.
+// Rewriting a block under another key only touches its header, so its data stays intact.
+// When opening a partition, pending blocks referenced by the chain are moved back into it
+// and all other pending blocks are wiped (see recoverChain).
+
+func pendingKey(key []byte) []byte {
+	return deriveKey(key, "pending")
+}
+
+func nextRef(blocks []*Block, i int) (int64, error) {
+	if i+1 >= len(blocks) {
+		return -1, nil
+	}
+	return blocks[i].refTo(blocks[i+1])
+}
+
+// steps reports the progress of an operation made of steps of size bytes each, e.g. rewriting a block.
+// A nil *steps reports nothing.
+type steps struct {
+	progress    Progress
+	done, total int64
+	size        int64
+}
+
+func newSteps(progress Progress, total, size int64) *steps {
+	if progress == nil {
+		return nil
+	}
+	return &steps{progress: progress, total: total, size: size}
+}
+
+func (s *steps) next() {
+	if s == nil {
+		return
+	}
+	s.done++
+	s.progress(s.done*s.size, s.total*s.size)
+}
+
+func (par *Partition) appendBlocks(blocks []*Block) error {
+	return par.appendBlocksContext(context.Background(), blocks, nil)
+}
+
+// appendBlocksContext links the blocks to the end of the partition, taking two steps per block when growing it.
+// The last block of the partition pointing to the first new one commits the change.
+// When creating a partition, the first new block is the commit instead.
+// If ctx is done before the commit, the new blocks are wiped and ctx.Err() is returned.
+func (par *Partition) appendBlocksContext(ctx context.Context, blocks []*Block, s *steps) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	start := 0
+	if len(par.blocks) == 0 {
+		start = 1
+	}
+	for i, b := range blocks {
+		b.tagged, b.copies = par.tagged, par.copies
+		if err := b.writeIndex(int64(len(par.blocks) + i)); err != nil {
+			return err
+		}
+	}
+	for i := len(blocks) - 1; i >= start; i-- {
+		if err := ctx.Err(); err != nil {
+			for _, b := range blocks {
+				if err := b.Delete(); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+		next, err := nextRef(blocks, i)
+		if err != nil {
+			return err
+		}
+		if _, err := blocks[i].rekey(pendingKey(par.keyFor(blocks[i].Disk)), next); err != nil {
+			return err
+		}
+		s.next()
+	}
+	if err := syncBlocks(blocks); err != nil {
+		return err
+	}
+	commit, next := blocks[0], int64(-1)
+	var err error
+	if start == 0 {
+		commit = par.blocks[len(par.blocks)-1]
+		next, err = commit.refTo(blocks[0])
+	} else {
+		next, err = nextRef(blocks, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if err := commit.Write(next); err != nil {
+		return err
+	}
+	if err := syncBlocks([]*Block{commit}); err != nil {
+		return err
+	}
+	for i := start; i < len(blocks); i++ {
+		next, err := nextRef(blocks, i)
+		if err != nil {
+			return err
+		}
+		if err := blocks[i].Write(next); err != nil {
+			return err
+		}
+		s.next()
+	}
+	par.blocks = append(par.blocks, blocks...)
+	return syncBlocks(blocks)
+}
+
+func (par *Partition) truncateBlocks(n int) error {
+	return par.truncateBlocksContext(context.Background(), n, nil)
+}
+
+// truncateBlocksContext removes all blocks starting with the n-th one and wipes them, taking two steps per block.
+// The blocks are moved to the pending key starting with the last one, so until the new last block is written
+// (or the first block has been moved when deleting the partition) opening the partition restores the old chain.
+// If ctx is done before that, the moved blocks are restored and ctx.Err() is returned.
+// Once committed the blocks are always wiped, so no data of them is left behind.
+func (par *Partition) truncateBlocksContext(ctx context.Context, n int, s *steps) error {
+	removed := par.blocks[n:]
+	for i := len(par.blocks) - 1; i >= n; i-- {
+		if err := ctx.Err(); err != nil {
+			for j := i + 1; j < len(par.blocks); j++ {
+				next, err := nextRef(par.blocks, j)
+				if err != nil {
+					return err
+				}
+				if err := par.blocks[j].Write(next); err != nil { //The blocks still have the partition's key
+					return err
+				}
+			}
+			if err := syncBlocks(removed); err != nil {
+				return err
+			}
+			return err
+		}
+		next, err := nextRef(par.blocks, i)
+		if err != nil {
+			return err
+		}
+		if _, err := par.blocks[i].rekey(pendingKey(par.keyFor(par.blocks[i].Disk)), next); err != nil {
+			return err
+		}
+		s.next()
+	}
+	if err := syncBlocks(removed); err != nil {
+		return err
+	}
+	if n > 0 {
+		if err := par.blocks[n-1].Write(-1); err != nil {
+			return err
+		}
+		if err := syncBlocks(par.blocks[n-1 : n]); err != nil {
+			return err
+		}
+	}
+	for _, b := range removed {
+		if err := b.Delete(); err != nil {
+			return err
+		}
+		s.next()
+	}
+	par.blocks = par.blocks[:n]
+	return syncBlocks(removed)
+}
+
+// recoverChain finishes an interrupted change of a chain.
+// Pending blocks referenced by the chain are rewritten under the key of the chain, all others are wiped.
+// A pending block referring to the first block of the chain becomes the new first block, this happens when
+// moving the first block (see moveBlock).
+// Read-only disks are left untouched, the recovered blocks only exist in memory.
+// It returns the blocks of the chain including the recovered ones.
+func recoverChain(blocks, pending []*Block, keyFor func(*Disk) []byte) ([]*Block, error) {
+	byNum := make(map[int64][]*Block, len(pending))
+	for _, b := range pending {
+		byNum[b.num] = append(byNum[b.num], b)
+	}
+	recovered := make(map[*Block]bool, len(pending))
+	resolve := func(from *Block, next int64) (*Block, error) {
+		for _, candidate := range byNum[next&blockRefNumMask] {
+			refers, err := from.refersTo(next, candidate)
+			if err != nil || refers && !recovered[candidate] {
+				return candidate, err
+			}
+		}
+		return nil, nil
+	}
+	rec := func(p *Block) (*Block, error) {
+		recovered[p] = true
+		next, err := p.GetNextBlockID()
+		if err != nil {
+			return nil, err
+		}
+		if p.Disk.readOnly {
+			return p.withKey(keyFor(p.Disk))
+		}
+		return p.rekey(keyFor(p.Disk), next)
+	}
+	result := append([]*Block{}, blocks...)
+	for _, b := range blocks {
+		from := b
+		next, err := from.GetNextBlockID()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			p, err := resolve(from, next)
+			if err != nil {
+				return nil, err
+			}
+			if p == nil {
+				break
+			}
+			if from, err = rec(p); err != nil {
+				return nil, err
+			}
+			result = append(result, from)
+			if next, err = from.GetNextBlockID(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for len(result) > 0 {
+		head, err := chainHead(result)
+		if err != nil {
+			return nil, err
+		}
+		var moved *Block
+		for _, p := range pending {
+			if recovered[p] {
+				continue
+			}
+			refers, err := p.pointsTo(head)
+			if err != nil {
+				return nil, err
+			}
+			if refers {
+				moved = p
+				break
+			}
+		}
+		if moved == nil {
+			break
+		}
+		nb, err := rec(moved)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, nb)
+	}
+	for _, p := range pending {
+		if recovered[p] || p.Disk.readOnly {
+			continue
+		}
+		if err := p.Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return result, syncBlocks(pending)
+}
+
+// chainHead returns a block of the chain no other block points to.
+func chainHead(blocks []*Block) (*Block, error) {
+	byNum := make(map[int64][]*Block, len(blocks))
+	for _, b := range blocks {
+		byNum[b.num] = append(byNum[b.num], b)
+	}
+	referenced := make(map[*Block]bool, len(blocks))
+	for _, b := range blocks {
+		next, err := b.GetNextBlockID()
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range byNum[next&blockRefNumMask] {
+			refers, err := b.refersTo(next, candidate)
+			if err != nil {
+				return nil, err
+			}
+			if refers {
+				referenced[candidate] = true
+			}
+		}
+	}
+	for _, b := range blocks {
+		if !referenced[b] {
+			return b, nil
+		}
+	}
+	return nil, nil
+}
+
+// scanChains works like scanBlocks but recovers interrupted changes of the chains first.
+func (d *Disk) scanChains(keys ...[]byte) ([][]*Block, error) {
+	return d.scanChainsContext(context.Background(), nil, keys...)
+}
+
+func (d *Disk) scanChainsContext(ctx context.Context, progress Progress, keys ...[]byte) ([][]*Block, error) {
+	allKeys := append([][]byte{}, keys...)
+	for _, key := range keys {
+		allKeys = append(allKeys, pendingKey(key))
+	}
+	found, err := d.scanBlocksContext(ctx, progress, allKeys...)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		pending := found[len(keys)+i]
+		if len(pending) == 0 {
+			continue
+		}
+		key := key
+		found[i], err = recoverChain(found[i], pending, func(*Disk) []byte { return key })
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found[:len(keys)], nil
+}
+
+func syncBlocks(blocks []*Block) error {
+	synced := map[*Disk]struct{}{}
+	for _, b := range blocks {
+		if b == nil {
+			continue
+		}
+		if _, ok := synced[b.Disk]; ok {
+			continue
+		}
+		if err := b.Disk.Sync(); err != nil {
+			return err
+		}
+		synced[b.Disk] = struct{}{}
+	}
+	return nil
+}
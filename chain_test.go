@@ -0,0 +1,187 @@
+package rubberhose_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+var errCrash = errors.New("simulated crash")
+
+func crashAfter(d *rubberhose.Disk, writes int) {
+	rubberhose.SetWriteHook(d, func() error {
+		if writes == 0 {
+			return errCrash
+		}
+		writes--
+		return nil
+	})
+}
+
+func TestCrashConsistency(t *testing.T) {
+	testPass := "test"
+	testBytes := []byte("Survives crashes")
+	operations := []struct {
+		name          string
+		before, after int //Block counts, 0 meaning no partition
+		run           func(d *rubberhose.Disk, p *rubberhose.Partition) error
+	}{
+		{"create", 0, 3, func(d *rubberhose.Disk, _ *rubberhose.Partition) error {
+			_, err := d.WritePartition(testPass, 3)
+			return err
+		}},
+		{"grow", 2, 4, func(_ *rubberhose.Disk, p *rubberhose.Partition) error { return p.Resize(4) }},
+		{"shrink", 4, 2, func(_ *rubberhose.Disk, p *rubberhose.Partition) error { return p.Resize(2) }},
+		{"delete", 2, 0, func(_ *rubberhose.Disk, p *rubberhose.Partition) error { return p.Delete() }},
+		{"shrink disk", 2, 2, func(d *rubberhose.Disk, _ *rubberhose.Partition) error { return d.Shrink(2, false) }},
+	}
+	for _, op := range operations {
+		for writes := 0; ; writes++ {
+			d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+			var p *rubberhose.Partition
+			if op.before > 0 {
+				var err error
+				p, err = d.WritePartition(testPass, int64(op.before))
+				require.NoError(t, err)
+				writeTestData(t, p, testBytes, 0)
+			}
+			crashAfter(d, writes)
+			err := op.run(d, p)
+			if err != nil {
+				require.Contains(t, err.Error(), errCrash.Error(), op.name)
+			}
+			for i := 0; i < 2; i++ { //The second time makes sure recovery left a clean disk
+				reopened, err := rubberhose.NewDisk(path)
+				require.NoError(t, err)
+				p, err = reopened.GetPartition(testPass)
+				if errors.Is(err, rubberhose.ErrNoPartition) {
+					require.True(t, op.before == 0 || op.after == 0, "%s crashed after %d writes", op.name, writes)
+					continue
+				}
+				require.NoError(t, err)
+				count := p.GetBlockCount()
+				require.True(t, count == op.before || count == op.after, "%s crashed after %d writes: %d blocks", op.name, writes, count)
+				if op.before > 0 {
+					requireData(t, p, testBytes, 0)
+				}
+			}
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+func TestConcurrentResize(t *testing.T) {
+	d, _ := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	p, err := d.WritePartition("test", 2)
+	require.NoError(t, err)
+	testBytes := []byte("Read during resizes")
+	writeTestData(t, p, testBytes, 0)
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := p.Resize(2 + i%5); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			return
+		default:
+			buf := make([]byte, 6*10) //Reaches into blocks that are being removed
+			if _, err := p.ReadAt(buf, 0); err != io.EOF {
+				require.NoError(t, err)
+			}
+			require.Equal(t, testBytes, buf[:len(testBytes)])
+		}
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	testPass := "test"
+	testBytes := []byte("Cancelled")
+	operations := []struct {
+		name          string
+		before, after int
+		run           func(ctx context.Context, p *rubberhose.Partition, progress rubberhose.Progress) error
+	}{
+		{"grow", 2, 5, func(ctx context.Context, p *rubberhose.Partition, progress rubberhose.Progress) error {
+			return p.ResizeContext(ctx, 5, progress)
+		}},
+		{"shrink", 5, 2, func(ctx context.Context, p *rubberhose.Partition, progress rubberhose.Progress) error {
+			return p.ResizeContext(ctx, 2, progress)
+		}},
+		{"delete", 3, 0, func(ctx context.Context, p *rubberhose.Partition, progress rubberhose.Progress) error {
+			return p.DeleteContext(ctx, progress)
+		}},
+	}
+	for _, op := range operations {
+		for steps := 1; ; steps++ { //Until the operation finishes before being cancelled
+			d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+			p, err := d.WritePartition(testPass, int64(op.before))
+			require.NoError(t, err)
+			writeTestData(t, p, testBytes, 0)
+			ctx, cancel := context.WithCancel(context.Background())
+			var reported, last, total int64
+			err = op.run(ctx, p, func(done, n int64) {
+				require.Greater(t, done, last)
+				last, total = done, n
+				if reported++; reported == int64(steps) {
+					cancel()
+				}
+			})
+			cancel()
+			cancelled := err != nil
+			count := op.after
+			if cancelled {
+				require.ErrorIs(t, err, context.Canceled, op.name)
+				count = op.before
+			} else {
+				require.Equal(t, total, last)
+			}
+			reopened, err := rubberhose.NewDisk(path)
+			require.NoError(t, err)
+			p, err = reopened.GetPartition(testPass)
+			if count == 0 {
+				require.ErrorIs(t, err, rubberhose.ErrNoPartition, "%s cancelled after %d steps", op.name, steps)
+				break
+			}
+			require.NoError(t, err)
+			require.Equal(t, count, p.GetBlockCount(), "%s cancelled after %d steps", op.name, steps)
+			requireData(t, p, testBytes, 0)
+			if !cancelled {
+				break
+			}
+		}
+	}
+}
+
+func TestCancelSearch(t *testing.T) {
+	d, _ := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	_, err := d.WritePartition("test", 2)
+	require.NoError(t, err)
+	reopened := rubberhose.NewDiskFromStorage(d.Storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = reopened.GetPartitionContext(ctx, "test", nil)
+	require.ErrorIs(t, err, context.Canceled)
+	var last, total int64
+	p, err := reopened.GetPartitionContext(context.Background(), "test", func(done, n int64) {
+		require.GreaterOrEqual(t, done, last)
+		last, total = done, n
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, p.GetBlockCount())
+	require.Equal(t, total, last)
+	require.Equal(t, int64(10*(rubberhose.MinBlockSize+10)), total)
+}
@@ -0,0 +1,303 @@
+package rubberhose
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	chunkSizeFile     = "chunksize"
+	maxOpenChunkFiles = 64
+)
+
+// ChunkedStorage stores a disk in a directory of numbered chunk files of a fixed size, only the last one may be
+// smaller. Changing data only changes the chunks holding it, so tools syncing the directory only transfer those.
+type ChunkedStorage struct {
+	dir       string
+	chunkSize int64
+	flag      int
+
+	mu     sync.Mutex
+	size   int64
+	open   map[int64]*list.Element
+	lru    *list.List
+	synced bool //False after chunk files were created or removed
+}
+
+type chunkFile struct {
+	num   int64
+	f     *os.File
+	dirty bool
+}
+
+// CreateChunkedStorage creates the directory and stores the chunk size in it.
+func CreateChunkedStorage(dir string, chunkSize int64) (*ChunkedStorage, error) {
+	if chunkSize < 1 {
+		return nil, errors.New("chunks need at least one byte")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, chunkSizeFile)); err == nil {
+		return nil, fmt.Errorf("%s already holds a chunked disk", dir)
+	}
+	if err := os.WriteFile(filepath.Join(dir, chunkSizeFile), []byte(strconv.FormatInt(chunkSize, 10)), 0644); err != nil {
+		return nil, err
+	}
+	return OpenChunkedStorage(dir, os.O_RDWR)
+}
+
+// OpenChunkedStorage opens a directory created by CreateChunkedStorage with the given os.OpenFile flags.
+func OpenChunkedStorage(dir string, flag int) (*ChunkedStorage, error) {
+	data, err := os.ReadFile(filepath.Join(dir, chunkSizeFile))
+	if err != nil {
+		return nil, err
+	}
+	chunkSize, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk size: %v", err)
+	}
+	s := &ChunkedStorage{dir: dir, chunkSize: chunkSize, flag: flag &^ (os.O_CREATE | os.O_TRUNC | os.O_EXCL), open: map[int64]*list.Element{}, lru: list.New(), synced: true}
+	for num := int64(0); ; num++ {
+		info, err := os.Stat(s.chunkPath(num))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.size = num*chunkSize + info.Size()
+	}
+	return s, nil
+}
+
+func (s *ChunkedStorage) chunkPath(num int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d", num))
+}
+
+// ChunkSize returns the size of all chunks but the last.
+func (s *ChunkedStorage) ChunkSize() int64 {
+	return s.chunkSize
+}
+
+func (s *ChunkedStorage) chunkCount(size int64) int64 {
+	return (size + s.chunkSize - 1) / s.chunkSize
+}
+
+// chunk returns the opened chunk file, creating it if create is set.
+// Only a limited number of chunk files is kept open, the least recently used one is closed.
+func (s *ChunkedStorage) chunk(num int64, create bool) (*chunkFile, error) {
+	if e, ok := s.open[num]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*chunkFile), nil
+	}
+	flag := s.flag
+	if create {
+		flag |= os.O_CREATE
+		s.synced = false
+	}
+	f, err := os.OpenFile(s.chunkPath(num), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &chunkFile{num: num, f: f}
+	s.open[num] = s.lru.PushFront(c)
+	for s.lru.Len() > maxOpenChunkFiles {
+		if err := s.closeChunk(s.lru.Back().Value.(*chunkFile)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *ChunkedStorage) closeChunk(c *chunkFile) error {
+	s.lru.Remove(s.open[c.num])
+	delete(s.open, c.num)
+	if c.dirty {
+		if err := c.f.Sync(); err != nil {
+			c.f.Close()
+			return err
+		}
+	}
+	return c.f.Close()
+}
+
+func (s *ChunkedStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > s.size {
+		end = s.size
+	}
+	n := 0
+	for pos := off; pos < end; {
+		num := pos / s.chunkSize
+		c, err := s.chunk(num, false)
+		if err != nil {
+			return n, err
+		}
+		length := (num+1)*s.chunkSize - pos
+		if length > end-pos {
+			length = end - pos
+		}
+		read, err := c.f.ReadAt(p[n:int64(n)+length], pos-num*s.chunkSize)
+		n += read
+		pos += int64(read)
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *ChunkedStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off > s.size {
+		if err := s.resize(off); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		num := pos / s.chunkSize
+		if num >= s.chunkCount(s.size) && s.size%s.chunkSize != 0 {
+			if err := s.resize(num * s.chunkSize); err != nil { //Fill up the last chunk before starting a new one
+				return n, err
+			}
+		}
+		c, err := s.chunk(num, num >= s.chunkCount(s.size))
+		if err != nil {
+			return n, err
+		}
+		length := (num+1)*s.chunkSize - pos
+		if length > int64(len(p)-n) {
+			length = int64(len(p) - n)
+		}
+		written, err := c.f.WriteAt(p[n:int64(n)+length], pos-num*s.chunkSize)
+		n += written
+		c.dirty = true
+		if end := off + int64(n); end > s.size {
+			s.size = end
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *ChunkedStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, nil
+}
+
+func (s *ChunkedStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size < 0 {
+		return fmt.Errorf("negative size %d", size)
+	}
+	return s.resize(size)
+}
+
+// resize removes or adds chunk files so that they hold size bytes, new space is filled with zeros.
+func (s *ChunkedStorage) resize(size int64) error {
+	oldCount, newCount := s.chunkCount(s.size), s.chunkCount(size)
+	for num := oldCount - 1; num >= newCount; num-- {
+		if e, ok := s.open[num]; ok {
+			c := e.Value.(*chunkFile)
+			c.dirty = false
+			if err := s.closeChunk(c); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(s.chunkPath(num)); err != nil {
+			return err
+		}
+		s.synced = false
+	}
+	for num := int64(0); num < newCount; num++ {
+		if num < oldCount-1 && num < newCount-1 {
+			continue //Full chunks that stay full
+		}
+		length := s.chunkSize
+		if num == newCount-1 {
+			length = size - num*s.chunkSize
+		}
+		c, err := s.chunk(num, num >= oldCount)
+		if err != nil {
+			return err
+		}
+		if err := c.f.Truncate(length); err != nil {
+			return err
+		}
+		c.dirty = true
+	}
+	s.size = size
+	return nil
+}
+
+// Sync flushes the changed chunk files and the directory if chunk files were created or removed.
+func (s *ChunkedStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*chunkFile)
+		if !c.dirty {
+			continue
+		}
+		if err := c.f.Sync(); err != nil {
+			return err
+		}
+		c.dirty = false
+	}
+	if s.synced {
+		return nil
+	}
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return err
+	}
+	s.synced = true
+	return nil
+}
+
+func (s *ChunkedStorage) Close() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.lru.Len() > 0 {
+		if err := s.closeChunk(s.lru.Front().Value.(*chunkFile)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
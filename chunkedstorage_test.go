@@ -0,0 +1,67 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "disk")
+	s, err := rubberhose.CreateChunkedStorage(dir, 100)
+	require.NoError(t, err)
+	_, err = rubberhose.CreateChunkedStorage(dir, 100)
+	require.Error(t, err)
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	writeTestData(t, s, data, 30)
+	size, err := s.Size()
+	require.NoError(t, err)
+	require.Equal(t, int64(280), size)
+	buf := make([]byte, 300)
+	n, err := s.ReadAt(buf, 0)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 280, n)
+	require.Equal(t, make([]byte, 30), buf[:30])
+	require.Equal(t, data, buf[30:n])
+	require.NoError(t, s.Truncate(150))
+	require.NoError(t, s.Close())
+	for _, c := range []struct {
+		name string
+		size int64
+	}{{"00000000", 100}, {"00000001", 50}} {
+		info, err := os.Stat(filepath.Join(dir, c.name))
+		require.NoError(t, err)
+		require.Equal(t, c.size, info.Size())
+	}
+	_, err = os.Stat(filepath.Join(dir, "00000002"))
+	require.True(t, os.IsNotExist(err))
+
+	d := rubberhose.NewDiskFromStorage(s)
+	require.NoError(t, d.Write(rubberhose.MinBlockSize+100, 10))
+	p, err := d.WritePartition("test", 5)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("chunked "), 40)
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, d.Grow(3))
+	require.NoError(t, d.Close())
+
+	d, err = rubberhose.NewDisk(dir)
+	require.NoError(t, err)
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(13), count)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+	require.NoError(t, d.Close())
+	size, err = s.Size()
+	require.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, int((size+99)/100)+1) //The chunks and the chunk size
+}
@@ -2,16 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	rubberhose "github.com/Cookie04DE/RubberHose"
 	"github.com/shenwei356/util/bytesize"
@@ -26,6 +31,23 @@ func fatalParsable(parsable bool, a ...interface{}) {
 	log.Fatal()
 }
 
+// readPasswords asks for passwords of partitions that aren't added until an empty one is entered.
+func readPasswords() []string {
+	var passwords []string
+	for {
+		fmt.Print("Enter the password of a partition on the disk that isn't added (empty to finish): ")
+		pw, err := term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			log.Fatal("Error reading password: ", err)
+		}
+		if len(pw) == 0 {
+			return passwords
+		}
+		passwords = append(passwords, string(pw))
+	}
+}
+
 func getPassword(password *string, parsable bool) string {
 	if pw := *password; pw != "" {
 		return pw
@@ -50,15 +72,36 @@ func main() {
 	parsable := flag.Bool("parsable", false, "Provide output in machine parsable output instead of human readable format")
 	disk := flag.String("disk", "", "The sekura disk to work on")
 	password := flag.String("password", "", "The password of the partition to work on (can also be provided interactively)")
+	copies := flag.Int("copies", 1, "The number of copies of a redundant partition")
+	readOnly := flag.Bool("readonly", false, "Open disks read-only, partitions on them can't be modified")
+	listen := flag.String("listen", "", "Serve the partition over NBD on this address (host:port or unix socket path) instead of exposing it as a device")
+	name := flag.String("name", "", "The NBD export name used with -listen")
+	input := flag.String("i", "", "The raw image to import")
+	output := flag.String("o", "", "The file to export the raw image to (- for stdout)")
+	blocks := flag.Int64("blocks", 0, "The number of blocks to add to the disk (grow) or to keep (shrink)")
+	force := flag.Bool("force", false, "Shrink even if used blocks beyond the new end belong to no added partition, e.g. to a pool")
+	fraction := flag.Float64("fraction", 0.1, "The fraction of the partition's blocks to move (shuffle)")
 	flag.Parse()
+	command := flag.Arg(0)
+	if flag.NArg() > 0 {
+		flag.CommandLine.Parse(flag.Args()[1:]) //Flags may also follow the command
+	}
 	if *standalone {
-		runStandaloneMode()
+		runStandaloneMode(*readOnly)
 		return
 	}
 	if len(os.Args) == 1 {
 		usage()
 		return
 	}
+	switch command {
+	case "mkfs", "put", "get", "ls":
+		runFileCommand(command, *disk, getPassword(password, *parsable), *parsable)
+		return
+	case "export", "import":
+		runImageCommand(command, *disk, getPassword(password, *parsable), *input, *output, *parsable)
+		return
+	}
 	conn, err := net.Dial("unix", "/run/sekura.sock")
 	if err != nil {
 		log.Fatal("Error opening connection to daemon: " + err.Error())
@@ -66,7 +109,7 @@ func main() {
 	rubberhose.RegisterGob()
 	d := gob.NewDecoder(conn)
 	e := gob.NewEncoder(conn)
-	switch flag.Arg(0) {
+	switch command {
 	default:
 		usage()
 		return
@@ -79,10 +122,13 @@ func main() {
 			log.Fatal("Error turning path into absolute path: " + err.Error())
 		}
 		pw := getPassword(password, *parsable)
-		err = e.Encode(&rubberhose.Request{ID: rubberhose.AddRequestID, Data: rubberhose.AddRequest{DiskPath: absPath, Password: pw}})
+		err = e.Encode(&rubberhose.Request{ID: rubberhose.AddRequestID, Data: rubberhose.AddRequest{DiskPath: absPath, Password: pw, ReadOnly: *readOnly, Address: *listen, Name: *name}, Progress: !*parsable})
 		if err != nil {
 			log.Fatal("Error writing to daemon socket: " + err.Error())
 		}
+		if !*parsable {
+			readProgress(d)
+		}
 		response := &rubberhose.AddResponse{}
 		err = d.Decode(response)
 		if err != nil {
@@ -105,10 +151,13 @@ func main() {
 			log.Fatal("Error turning path into absolute path: " + err.Error())
 		}
 		pw := getPassword(password, *parsable)
-		err = e.Encode(&rubberhose.Request{ID: rubberhose.DeleteRequestID, Data: rubberhose.DeleteRequest{DiskPath: absPath, Password: pw}})
+		err = e.Encode(&rubberhose.Request{ID: rubberhose.DeleteRequestID, Data: rubberhose.DeleteRequest{DiskPath: absPath, Password: pw}, Progress: !*parsable})
 		if err != nil {
 			log.Fatal("Error writing to daemon socket: " + err.Error())
 		}
+		if !*parsable {
+			readProgress(d)
+		}
 		response := &rubberhose.DeleteResponse{}
 		err = d.Decode(response)
 		if err != nil {
@@ -121,19 +170,478 @@ func main() {
 			return
 		}
 		fmt.Println("Successfully deleted partition!")
+	case "scrub":
+		if *disk == "" {
+			log.Fatal("Please provide a disk with the -disk flag")
+		}
+		absPath, err := filepath.Abs(*disk)
+		if err != nil {
+			log.Fatal("Error turning path into absolute path: " + err.Error())
+		}
+		pw := getPassword(password, *parsable)
+		err = e.Encode(&rubberhose.Request{ID: rubberhose.ScrubRequestID, Data: rubberhose.ScrubRequest{DiskPath: absPath, Password: pw, Copies: *copies}})
+		if err != nil {
+			log.Fatal("Error writing to daemon socket: " + err.Error())
+		}
+		response := &rubberhose.ScrubResponse{}
+		err = d.Decode(response)
+		if err != nil {
+			log.Fatal("Error reading from daemon socket: " + err.Error())
+		}
+		if response.Error != "" {
+			log.Fatal("Deamon reported error while scrubbing partition: " + response.Error)
+		}
+		printScrubResult(response.BlocksChecked, response.Repaired, response.Damaged, *parsable)
+	case "info":
+		if *disk == "" {
+			log.Fatal("Please provide a disk with the -disk flag")
+		}
+		absPath, err := filepath.Abs(*disk)
+		if err != nil {
+			log.Fatal("Error turning path into absolute path: " + err.Error())
+		}
+		pw := getPassword(password, *parsable)
+		err = e.Encode(&rubberhose.Request{ID: rubberhose.InfoRequestID, Data: rubberhose.InfoRequest{DiskPath: absPath, Password: pw}})
+		if err != nil {
+			log.Fatal("Error writing to daemon socket: " + err.Error())
+		}
+		response := &rubberhose.InfoResponse{}
+		err = d.Decode(response)
+		if err != nil {
+			log.Fatal("Error reading from daemon socket: " + err.Error())
+		}
+		if response.Error != "" {
+			log.Fatal("Deamon reported error while reading partition info: " + response.Error)
+		}
+		printPartitionInfo(response.PartitionInfo, *parsable)
+	case "grow", "shrink":
+		if *disk == "" {
+			log.Fatal("Please provide a disk with the -disk flag")
+		}
+		if *blocks <= 0 {
+			log.Fatal("Please provide the block count with the -blocks flag")
+		}
+		absPath, err := filepath.Abs(*disk)
+		if err != nil {
+			log.Fatal("Error turning path into absolute path: " + err.Error())
+		}
+		var request interface{} = rubberhose.GrowRequest{DiskPath: absPath, ExtraBlocks: *blocks}
+		id := rubberhose.GrowRequestID
+		if command == "shrink" {
+			var passwords []string
+			if *password != "" {
+				passwords = []string{*password}
+			} else if !*parsable {
+				passwords = readPasswords()
+			}
+			request = rubberhose.ShrinkRequest{DiskPath: absPath, BlockCount: *blocks, Passwords: passwords, Force: *force}
+			id = rubberhose.ShrinkRequestID
+		}
+		err = e.Encode(&rubberhose.Request{ID: id, Data: request})
+		if err != nil {
+			log.Fatal("Error writing to daemon socket: " + err.Error())
+		}
+		var responseError string
+		var blockCount int64
+		if command == "shrink" {
+			response := &rubberhose.ShrinkResponse{}
+			err = d.Decode(response)
+			responseError, blockCount = response.Error, response.BlockCount
+		} else {
+			response := &rubberhose.GrowResponse{}
+			err = d.Decode(response)
+			responseError, blockCount = response.Error, response.BlockCount
+		}
+		if err != nil {
+			log.Fatal("Error reading from daemon socket: " + err.Error())
+		}
+		if responseError != "" {
+			log.Fatal("Deamon reported error while resizing disk: " + responseError)
+		}
+		if *parsable {
+			fmt.Print(blockCount)
+			return
+		}
+		fmt.Printf("Success. The disk now has %d blocks.\n", blockCount)
+	case "shuffle":
+		if *disk == "" {
+			log.Fatal("Please provide a disk with the -disk flag")
+		}
+		absPath, err := filepath.Abs(*disk)
+		if err != nil {
+			log.Fatal("Error turning path into absolute path: " + err.Error())
+		}
+		pw := getPassword(password, *parsable)
+		err = e.Encode(&rubberhose.Request{ID: rubberhose.ShuffleRequestID, Data: rubberhose.ShuffleRequest{DiskPath: absPath, Password: pw, Fraction: *fraction}})
+		if err != nil {
+			log.Fatal("Error writing to daemon socket: " + err.Error())
+		}
+		response := &rubberhose.ShuffleResponse{}
+		err = d.Decode(response)
+		if err != nil {
+			log.Fatal("Error reading from daemon socket: " + err.Error())
+		}
+		if response.Error != "" {
+			log.Fatal("Deamon reported error while shuffling partition: " + response.Error)
+		}
+		if *parsable {
+			fmt.Print(response.Moved)
+			return
+		}
+		fmt.Printf("Success. Moved %d blocks.\n", response.Moved)
+	case "list":
+		err = e.Encode(&rubberhose.Request{ID: rubberhose.ListRequestID, Data: rubberhose.ListRequest{}})
+		if err != nil {
+			log.Fatal("Error writing to daemon socket: " + err.Error())
+		}
+		response := &rubberhose.ListResponse{}
+		err = d.Decode(response)
+		if err != nil {
+			log.Fatal("Error reading from daemon socket: " + err.Error())
+		}
+		if response.Error != "" {
+			log.Fatal("Deamon reported error while listing partitions: " + response.Error)
+		}
+		for _, info := range response.Partitions {
+			printPartitionInfo(info, *parsable)
+			if !*parsable {
+				fmt.Println()
+			}
+		}
+	}
+}
+
+func printPartitionInfo(info rubberhose.PartitionInfo, parsable bool) {
+	m := info.Metadata
+	if m == nil {
+		m = &rubberhose.Metadata{}
+	}
+	if parsable {
+		fmt.Printf("%s\t%s\t%d\t%d\t%q\t%s\t%s\t%q\t%q\n", info.DiskPath, info.DevicePath, info.BlockCount, info.Size, m.Label, m.UUID, m.Created.Format(time.RFC3339), m.Filesystem, m.Notes)
+		return
+	}
+	fmt.Printf("Disk: %s\n", info.DiskPath)
+	if info.DevicePath != "" {
+		fmt.Printf("Exposed as: %s\n", info.DevicePath)
+	}
+	fmt.Printf("Blockcount: %d, Total Size: %s\n", info.BlockCount, ByteSizeToHumanReadable(info.Size))
+	printMetadata(info.Metadata)
+}
+
+func printMetadata(m *rubberhose.Metadata) {
+	if m == nil {
+		fmt.Println("No metadata")
+		return
+	}
+	fmt.Printf("Label: %s\nUUID: %s\nCreated: %s\n", m.Label, m.UUID, m.Created.Local().Format(time.RFC1123))
+	if m.Filesystem != "" {
+		fmt.Printf("File system: %s\n", m.Filesystem)
+	}
+	if m.Notes != "" {
+		fmt.Printf("Notes: %s\n", m.Notes)
+	}
+}
+
+func printScrubResult(checked, repaired int, damaged []rubberhose.DamagedRange, parsable bool) {
+	if parsable {
+		fmt.Printf("%d %d", checked, repaired)
+		for _, r := range damaged {
+			fmt.Printf(" %d-%d", r.Offset, r.Offset+r.Length)
+		}
+		return
+	}
+	fmt.Printf("Checked %d blocks, repaired %d.\n", checked, repaired)
+	if len(damaged) == 0 {
+		fmt.Println("No damaged data found.")
+		return
+	}
+	fmt.Println("Damaged data that couldn't be repaired:")
+	for _, r := range damaged {
+		fmt.Printf(" bytes %d to %d (%s)\n", r.Offset, r.Offset+r.Length, ByteSizeToHumanReadable(r.Length))
+	}
+}
+
+// runFileCommand works on the file system inside a partition without the daemon or root permissions.
+func runFileCommand(cmd, diskPath, password string, parsable bool) {
+	if diskPath == "" {
+		log.Fatal("Please provide a disk with the -disk flag")
+	}
+	readOnly := cmd == "get" || cmd == "ls"
+	var disk *rubberhose.Disk
+	var err error
+	if readOnly {
+		disk, err = rubberhose.NewDiskReadOnly(diskPath)
+	} else {
+		disk, err = rubberhose.NewDisk(diskPath)
+	}
+	if err != nil {
+		log.Fatal("Error opening disk: " + err.Error())
+	}
+	defer disk.Close()
+	partition, err := disk.GetPartition(password)
+	if err != nil && err != rubberhose.ErrRedundancyDegraded {
+		log.Fatal("Error reading partition: " + err.Error())
+	}
+	if cmd == "mkfs" {
+		if _, err := rubberhose.FormatFS(partition); err != nil {
+			log.Fatal("Error creating file system: " + err.Error())
+		}
+		if !parsable {
+			fmt.Println("Success! Files can now be stored with put.")
+		}
+		return
+	}
+	fsys, err := rubberhose.OpenFS(partition)
+	if err != nil {
+		log.Fatal("Error opening file system: " + err.Error())
+	}
+	switch cmd {
+	case "put":
+		if flag.NArg() < 1 {
+			log.Fatal("Usage: sekura -disk <disk> put <local file> [path]")
+		}
+		name := filepath.Base(flag.Arg(0))
+		if flag.NArg() > 1 {
+			name = strings.Trim(flag.Arg(1), "/")
+		}
+		in := os.Stdin
+		if flag.Arg(0) != "-" {
+			in, err = os.Open(flag.Arg(0))
+			if err != nil {
+				log.Fatal("Error opening file: " + err.Error())
+			}
+			defer in.Close()
+		}
+		if err := fsys.MkdirAll(path.Dir(name)); err != nil {
+			log.Fatal("Error creating directory: " + err.Error())
+		}
+		w, err := fsys.Create(name)
+		if err != nil {
+			log.Fatal("Error creating file: " + err.Error())
+		}
+		n, err := io.Copy(w, in)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			log.Fatal("Error writing file: " + err.Error())
+		}
+		if !parsable {
+			fmt.Printf("Stored %s as %s\n", ByteSizeToHumanReadable(n), name)
+		}
+	case "get":
+		if flag.NArg() < 1 {
+			log.Fatal("Usage: sekura -disk <disk> get <path> [local file]")
+		}
+		name := strings.Trim(flag.Arg(0), "/")
+		f, err := fsys.Open(name)
+		if err != nil {
+			log.Fatal("Error opening file: " + err.Error())
+		}
+		defer f.Close()
+		out := os.Stdout
+		if target := flag.Arg(1); target != "-" {
+			if target == "" {
+				target = path.Base(name)
+			}
+			out, err = os.Create(target)
+			if err != nil {
+				log.Fatal("Error creating file: " + err.Error())
+			}
+			defer out.Close()
+		}
+		if _, err := io.Copy(out, f); err != nil {
+			log.Fatal("Error reading file: " + err.Error())
+		}
+	case "ls":
+		dir := strings.Trim(flag.Arg(0), "/")
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			log.Fatal("Error listing directory: " + err.Error())
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				log.Fatal("Error reading file info: " + err.Error())
+			}
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			if parsable {
+				fmt.Printf("%s\t%d\t%s\n", name, info.Size(), info.ModTime().Format(time.RFC3339))
+				continue
+			}
+			fmt.Printf("%10s  %s  %s\n", ByteSizeToHumanReadable(info.Size()), info.ModTime().Local().Format("2006-01-02 15:04"), name)
+		}
+		if !parsable {
+			free, total := fsys.Space()
+			fmt.Printf("%s of %s free\n", ByteSizeToHumanReadable(free), ByteSizeToHumanReadable(total))
+		}
+	}
+}
+
+const progressBarWidth = 30
+
+// progressBar prints the progress of an operation as a bar, redrawing it whenever the percentage changes.
+type progressBar struct {
+	w       io.Writer
+	label   string
+	percent int64
+	shown   bool
+}
+
+func newProgressBar(w io.Writer, label string) *progressBar {
+	return &progressBar{w: w, label: label, percent: -1}
+}
+
+func (b *progressBar) Report(done, total int64) {
+	percent := int64(100)
+	if total > 0 {
+		percent = done * 100 / total
+	}
+	if percent == b.percent {
+		return
+	}
+	b.percent, b.shown = percent, true
+	filled := int(percent * progressBarWidth / 100)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	fmt.Fprintf(b.w, "\r%s [%s] %3d%% %s of %s  ", b.label, bar, percent, ByteSizeToHumanReadable(done), ByteSizeToHumanReadable(total))
+}
+
+// Finish ends the line of the bar if it was printed.
+func (b *progressBar) Finish() {
+	if b.shown {
+		fmt.Fprintln(b.w)
+		b.shown = false
+	}
+}
+
+// readProgress prints the ProgressUpdates the daemon sends before its response.
+func readProgress(d *gob.Decoder) {
+	var bar *progressBar
+	for {
+		update := &rubberhose.ProgressUpdate{}
+		if err := d.Decode(update); err != nil {
+			log.Fatal("Error reading from daemon socket: " + err.Error())
+		}
+		if bar != nil && (update.Final || update.Stage != bar.label) {
+			bar.Finish()
+		}
+		if update.Final {
+			return
+		}
+		if bar == nil || update.Stage != bar.label {
+			bar = newProgressBar(os.Stderr, update.Stage)
+		}
+		bar.Report(update.Done, update.Total)
+	}
+}
+
+// runImageCommand copies a partition from or to a raw image without the daemon or root permissions.
+func runImageCommand(cmd, diskPath, password, input, output string, parsable bool) {
+	if diskPath == "" {
+		log.Fatal("Please provide a disk with the -disk flag")
+	}
+	var progress rubberhose.Progress
+	if !parsable {
+		progress = newProgressBar(os.Stderr, strings.Title(cmd)+"ing").Report
+	}
+	var checksum []byte
+	switch cmd {
+	case "export":
+		if output == "" {
+			log.Fatal("Please provide the image file with the -o flag")
+		}
+		disk, err := rubberhose.NewDiskReadOnly(diskPath)
+		if err != nil {
+			log.Fatal("Error opening disk: " + err.Error())
+		}
+		defer disk.Close()
+		partition, err := disk.GetPartition(password)
+		if err != nil && err != rubberhose.ErrRedundancyDegraded {
+			log.Fatal("Error reading partition: " + err.Error())
+		}
+		out := os.Stdout
+		if output != "-" {
+			out, err = os.Create(output)
+			if err != nil {
+				log.Fatal("Error creating image: " + err.Error())
+			}
+		}
+		checksum, err = partition.ExportImage(out, progress)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatal("\nError exporting image: " + err.Error())
+		}
+	case "import":
+		if input == "" {
+			log.Fatal("Please provide the image file with the -i flag")
+		}
+		in, err := os.Open(input)
+		if err != nil {
+			log.Fatal("Error opening image: " + err.Error())
+		}
+		defer in.Close()
+		size, err := in.Seek(0, io.SeekEnd) //Also works for block devices
+		if err == nil {
+			_, err = in.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			log.Fatal("Error reading image size: " + err.Error())
+		}
+		disk, err := rubberhose.NewDisk(diskPath)
+		if err != nil {
+			log.Fatal("Error opening disk: " + err.Error())
+		}
+		defer disk.Close()
+		partition, sum, err := disk.ImportImage(password, in, size, progress)
+		if err != nil {
+			log.Fatal("\nError importing image: " + err.Error())
+		}
+		checksum = sum
+		if !parsable {
+			fmt.Fprintf(os.Stderr, "\nCreated partition with %d blocks, Total Size: %s", partition.GetBlockCount(), ByteSizeToHumanReadable(partition.GetDataSize()))
+		}
+	}
+	if parsable {
+		fmt.Printf("%x\n", checksum)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "\nSHA-256: %x\n", checksum)
 }
 
 func usage() {
 	fmt.Println(`Sekura CLI
 Commands:
- add: -disk required, -password optional
+ add: -disk required, -password optional, -readonly optional, -listen and -name optional
+      WARNING: if the daemon runs with -cover, partitions on the disk that aren't added are destroyed
  remove: -disk required -password optional
+ scrub: -disk required, -password optional, -copies optional
+ info: -disk required, -password optional
+ list
+ grow: -disk required, -blocks required (number of blocks to add)
+ shrink: -disk required, -blocks required (number of blocks to keep), -password optional, -force optional
+ shuffle: -disk required, -password optional, -fraction optional
+ mkfs: -disk required, -password optional
+ put <local file> [path]: -disk required, -password optional
+ get <path> [local file]: -disk required, -password optional
+ ls [directory]: -disk required, -password optional
+ export: -disk required, -o required, -password optional
+ import: -disk required, -i required, -password optional
 Example:
 $ sekura -disk /path/to/my/disk add`)
 }
 
-func runStandaloneMode() {
+func runStandaloneMode(readOnly bool) {
 	if unix.Geteuid() != 0 {
 		log.Fatal("Sekura requires root permissions to work")
 	}
@@ -166,7 +674,11 @@ scanloop:
 				fmt.Println("Error turning path into absolute path: " + err.Error())
 				continue scanloop
 			}
-			disk, err := rubberhose.NewDisk(absPath)
+			open := rubberhose.NewDisk
+			if readOnly {
+				open = rubberhose.NewDiskReadOnly
+			}
+			disk, err := open(absPath)
 			if err != nil {
 				fmt.Println("Error opening disk: " + err.Error())
 				continue scanloop
@@ -205,11 +717,31 @@ scanloop:
 			}
 			var blockCount int64
 			var disk *rubberhose.Disk
+			device := false
 			if _, err := os.Stat(absPath); err != nil {
-				f, err := os.Create(absPath)
-				if err != nil {
-					fmt.Println("Error creating disk: " + err.Error())
-					continue scanloop
+				var storage rubberhose.Storage
+				if strings.HasSuffix(path, string(filepath.Separator)) {
+					fmt.Print("Enter chunk size: ")
+					if !scanner.Scan() {
+						break scanloop
+					}
+					cs, err := bytesize.Parse([]byte(scanner.Text()))
+					if err != nil {
+						fmt.Println("Error parsing byte size: " + err.Error())
+						continue scanloop
+					}
+					storage, err = rubberhose.CreateChunkedStorage(absPath, int64(cs))
+					if err != nil {
+						fmt.Println("Error creating disk: " + err.Error())
+						continue scanloop
+					}
+				} else {
+					f, err := os.Create(absPath)
+					if err != nil {
+						fmt.Println("Error creating disk: " + err.Error())
+						continue scanloop
+					}
+					storage = rubberhose.FileStorage{File: f}
 				}
 				fmt.Print("Enter block count: ")
 				if !scanner.Scan() {
@@ -221,69 +753,200 @@ scanloop:
 					continue scanloop
 				}
 				blockCount = int64(bc)
-				disk = rubberhose.NewDiskFromFile(f)
+				disk = rubberhose.NewDiskFromStorage(storage)
 			} else {
 				d, err := rubberhose.NewDisk(absPath)
 				if err != nil {
 					fmt.Println("Error opening disk: " + err.Error())
+					continue scanloop
 				}
 				disk = d
+				device = disk.IsBlockDevice()
+			}
+			if device {
+				fmt.Print("The whole device will be overwritten with random data, continue (y/N): ")
+				if !scanner.Scan() {
+					break scanloop
+				}
+				if strings.ToLower(scanner.Text()) != "y" {
+					disk.Close()
+					continue scanloop
+				}
+			}
+			bar := newProgressBar(os.Stdout, "Writing")
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			if device {
+				err = disk.WriteFullContext(ctx, int64(bs), bar.Report)
+			} else {
+				err = disk.WriteContext(ctx, int64(bs), blockCount, bar.Report)
 			}
-			err = disk.Write(int64(bs), blockCount)
+			stop()
+			bar.Finish()
 			if err != nil {
 				fmt.Println("Error writing disk: " + err.Error())
 				continue scanloop
 			}
 			disks = append(disks, disk)
+			if device {
+				bc, err := disk.GetBlockCount()
+				if err != nil {
+					fmt.Println("Error reading disk block count: " + err.Error())
+					continue scanloop
+				}
+				fmt.Printf("Success! Disk num %d (Blockcount: %d).\n", len(disks), bc)
+				continue scanloop
+			}
 			fmt.Printf("Success! Disk num %d.\n", len(disks))
-		case "addpartition":
-			state, partition := getPartition(disks, scanner, false)
+		case "growdisk", "shrinkdisk":
+			fmt.Print("Enter disk num: ")
+			state, disk := getSingleDisk(disks, scanner)
 			switch state {
 			case Break:
 				break scanloop
 			case Continue:
 				continue scanloop
 			}
-			path, _ := partition.Expose()
-			fmt.Printf("Success! Partition exposed as %s! Blockcount: %d, Total Size: %s\n", path, partition.GetBlockCount(), ByteSizeToHumanReadable(partition.GetDataSize()))
-		case "createpartition":
-			fmt.Print("Enter disk num: ")
+			if cmd == "growdisk" {
+				fmt.Print("Enter number of blocks to add: ")
+			} else {
+				fmt.Print("Enter new block count: ")
+			}
 			if !scanner.Scan() {
 				break scanloop
 			}
-			diskNum, err := strconv.Atoi(scanner.Text())
+			blocks, err := strconv.ParseInt(scanner.Text(), 10, 64)
 			if err != nil {
-				fmt.Println("Error parsing disk num: " + err.Error())
+				fmt.Println("Error parsing block count: " + err.Error())
 				continue scanloop
 			}
-			if diskNum > len(disks) {
-				fmt.Println("Invalid disk num")
-				continue scanloop
+			if cmd == "growdisk" {
+				err = disk.Grow(blocks)
+			} else {
+				passwords := readPasswords()
+				err = disk.Shrink(blocks, false, passwords...)
+				if err == rubberhose.ErrUnownedBlocks {
+					fmt.Print("Used blocks beyond the new end belong to no added partition, destroy them (y/N): ")
+					if !scanner.Scan() {
+						break scanloop
+					}
+					if strings.ToLower(scanner.Text()) != "y" {
+						continue scanloop
+					}
+					err = disk.Shrink(blocks, true, passwords...)
+				}
 			}
-			diskNum--
-			disk := disks[diskNum]
-			password := ""
-			pw := getPassword(&password, false)
-			_, err = disk.GetPartition(pw)
-			if err == nil {
-				fmt.Println("A partition with this password already exists!")
+			if err != nil {
+				fmt.Println("Error resizing disk: " + err.Error())
 				continue scanloop
 			}
-			fmt.Print("Enter block count: ")
-			if !scanner.Scan() {
-				break scanloop
-			}
-			blockCount, err := strconv.Atoi(scanner.Text())
+			blockCount, err := disk.GetBlockCount()
 			if err != nil {
-				fmt.Println("Error parsing block count: " + err.Error())
+				fmt.Println("Error reading block count: " + err.Error())
 				continue scanloop
 			}
-			partition, err := disk.WritePartition(pw, int64(blockCount))
-			if err != nil {
+			fmt.Printf("Success! The disk now has %d blocks.\n", blockCount)
+		case "addpartition":
+			state, partition := getPartition(disks, scanner, false)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			path := expose(partition)
+			fmt.Printf("Success! Partition exposed as %s! Blockcount: %d, Total Size: %s\n", path, partition.GetBlockCount(), ByteSizeToHumanReadable(partition.GetDataSize()))
+			if metadata, err := partition.GetMetadata(); err == nil {
+				printMetadata(metadata)
+			}
+		case "info":
+			state, partition := getPartition(disks, scanner, false)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			metadata, err := partition.GetMetadata()
+			if err != nil && err != rubberhose.ErrNoMetadata {
+				fmt.Println("Error reading metadata: " + err.Error())
+				continue scanloop
+			}
+			printMetadata(metadata)
+			fmt.Print("Edit metadata (y/N): ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			if strings.ToLower(scanner.Text()) != "y" {
+				continue scanloop
+			}
+			if metadata == nil {
+				metadata, err = rubberhose.NewMetadata("")
+				if err != nil {
+					fmt.Println("Error creating metadata: " + err.Error())
+					continue scanloop
+				}
+			}
+			for _, field := range []struct {
+				name  string
+				value *string
+			}{{"label", &metadata.Label}, {"file system", &metadata.Filesystem}, {"notes", &metadata.Notes}} {
+				fmt.Printf("Enter %s (empty keeps %q): ", field.name, *field.value)
+				if !scanner.Scan() {
+					break scanloop
+				}
+				if scanner.Text() != "" {
+					*field.value = scanner.Text()
+				}
+			}
+			if err := partition.SetMetadata(metadata); err != nil {
+				fmt.Println("Error writing metadata: " + err.Error())
+				continue scanloop
+			}
+			fmt.Println("Success!")
+		case "createpartition":
+			state, disk := getDisk(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			_, err := disk.GetPartition(pw)
+			if err == nil || err == rubberhose.ErrRedundancyDegraded {
+				fmt.Println("A partition with this password already exists!")
+				continue scanloop
+			}
+			fmt.Print("Enter block count: ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			blockCount, err := strconv.Atoi(scanner.Text())
+			if err != nil {
+				fmt.Println("Error parsing block count: " + err.Error())
+				continue scanloop
+			}
+			fmt.Print("Enter label (optional): ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			label := scanner.Text()
+			partition, err := disk.WritePartition(pw, int64(blockCount))
+			if err != nil {
 				fmt.Println("Error writing partition: " + err.Error())
 				continue scanloop
 			}
-			path, _ := partition.Expose()
+			if label != "" {
+				metadata, err := rubberhose.NewMetadata(label)
+				if err == nil {
+					err = partition.SetMetadata(metadata)
+				}
+				if err != nil {
+					fmt.Println("Error writing metadata: " + err.Error())
+				}
+			}
+			path := expose(partition)
 			fmt.Printf("Success! Partition exposed as %s!\n", path)
 		case "delete":
 			state, partition := getPartition(disks, scanner, true)
@@ -293,7 +956,11 @@ scanloop:
 			case Continue:
 				continue scanloop
 			}
-			err := partition.Delete()
+			bar := newProgressBar(os.Stdout, "Deleting")
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			err := partition.DeleteContext(ctx, bar.Report)
+			stop()
+			bar.Finish()
 			if err != nil {
 				fmt.Println("Error deleting partition: " + err.Error())
 				continue scanloop
@@ -316,27 +983,383 @@ scanloop:
 				fmt.Println("Error parsing block count: " + err.Error())
 				continue scanloop
 			}
-			err = partition.Resize(blockCount)
+			bar := newProgressBar(os.Stdout, "Resizing")
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			err = partition.ResizeContext(ctx, blockCount, bar.Report)
+			stop()
+			bar.Finish()
 			if err != nil {
 				fmt.Println("Error resizing partition: " + err.Error())
 				continue scanloop
 			}
-			path, _ := partition.Expose()
+			path := expose(partition)
 			fmt.Println("Successfully resized partition. Exposed as ", path, "!")
+		case "createmirror":
+			state, disk, mirror := getMirrorDisks(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			_, err := disk.GetMirroredPartition(mirror, pw)
+			if err == nil || err == rubberhose.ErrMirrorDegraded {
+				fmt.Println("A partition with this password already exists!")
+				continue scanloop
+			}
+			fmt.Print("Enter block count: ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			blockCount, err := strconv.Atoi(scanner.Text())
+			if err != nil {
+				fmt.Println("Error parsing block count: " + err.Error())
+				continue scanloop
+			}
+			partition, err := disk.WriteMirroredPartition(mirror, pw, int64(blockCount))
+			if err != nil {
+				fmt.Println("Error writing mirrored partition: " + err.Error())
+				continue scanloop
+			}
+			path := expose(partition)
+			fmt.Printf("Success! Mirrored partition exposed as %s!\n", path)
+		case "addmirror":
+			state, disk, mirror := getMirrorDisks(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			partition, err := disk.GetMirroredPartition(mirror, pw)
+			if err == rubberhose.ErrMirrorDegraded {
+				fmt.Println("Warning: only one side of the mirror could be opened. Replace the broken disk and use resync.")
+			} else if err != nil {
+				fmt.Println("Error opening mirrored partition: " + err.Error())
+				continue scanloop
+			}
+			path := expose(partition)
+			fmt.Printf("Success! Partition exposed as %s! Blockcount: %d, Total Size: %s\n", path, partition.GetBlockCount(), ByteSizeToHumanReadable(partition.GetDataSize()))
+		case "resync":
+			state, disk, mirror := getMirrorDisks(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			partition, err := disk.ResyncMirror(mirror, pw)
+			if err != nil {
+				fmt.Println("Error resyncing mirror: " + err.Error())
+				continue scanloop
+			}
+			path := expose(partition)
+			fmt.Printf("Successfully resynced mirror. Exposed as %s!\n", path)
+		case "scrub":
+			state, partition := getPartition(disks, scanner, false)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			result, err := partition.Scrub()
+			if err != nil {
+				fmt.Println("Error scrubbing partition: " + err.Error())
+				continue scanloop
+			}
+			printScrubResult(result.BlocksChecked, result.Repaired, result.Damaged, false)
+		case "shuffle":
+			state, partition := getPartition(disks, scanner, false)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			fmt.Print("Enter the fraction of blocks to move (e.g. 0.1): ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			fraction, err := strconv.ParseFloat(scanner.Text(), 64)
+			if err != nil {
+				fmt.Println("Error parsing fraction: " + err.Error())
+				continue scanloop
+			}
+			moved, err := partition.Shuffle(fraction)
+			if err != nil {
+				fmt.Println("Error shuffling partition: " + err.Error())
+				continue scanloop
+			}
+			fmt.Printf("Success! Moved %d blocks.\n", moved)
+		case "serve":
+			state, partition := getPartition(disks, scanner, false)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			fmt.Print("Enter address (host:port or path of a unix socket): ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			address := strings.TrimSpace(scanner.Text())
+			fmt.Print("Enter export name: ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			name := scanner.Text()
+			server, ok := servers[address]
+			if !ok {
+				server = rubberhose.NewNBDServer()
+				if _, err := server.Listen(address); err != nil {
+					fmt.Println("Error listening: " + err.Error())
+					continue scanloop
+				}
+				servers[address] = server
+			}
+			if _, err := partition.ExportWith(&rubberhose.NetworkExporter{Server: server, Name: name}); err != nil {
+				fmt.Println("Error serving partition: " + err.Error())
+				continue scanloop
+			}
+			exposed = append(exposed, partition)
+			fmt.Printf("Success! Partition served as %q on %s!\n", name, address)
+		case "cache":
+			state, partition := getPartition(disks, scanner, false)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			stats := partition.CacheStats()
+			fmt.Printf("Hits: %d, Misses: %d (Hit rate: %.1f%%), Evictions: %d, Write backs: %d\n", stats.Hits, stats.Misses, stats.HitRate()*100, stats.Evictions, stats.WriteBacks)
+			fmt.Print("Enter cache size (0 disables the cache): ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			size, err := bytesize.Parse([]byte(scanner.Text()))
+			if err != nil {
+				fmt.Println("Error parsing byte size: " + err.Error())
+				continue scanloop
+			}
+			fmt.Print("Write back (y/N): ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			policy := rubberhose.WriteThrough
+			if strings.ToLower(scanner.Text()) == "y" {
+				policy = rubberhose.WriteBack
+			}
+			if err := partition.SetCache(int64(size), policy); err != nil {
+				fmt.Println("Error setting cache: " + err.Error())
+				continue scanloop
+			}
+			fmt.Println("Success!")
+		case "fsck":
+			fmt.Print("Enter disk num: ")
+			state, disk := getSingleDisk(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			result, err := disk.Fsck(pw)
+			if err != nil {
+				fmt.Println("Error checking partition: " + err.Error())
+				continue scanloop
+			}
+			var blockCount int
+			for _, f := range result.Fragments {
+				blockCount += f.Blocks
+			}
+			fmt.Printf("Found %d valid blocks in %d fragments (%d gaps, %d orphans).\n", blockCount, len(result.Fragments), result.Gaps(), result.Orphans())
+			for i, f := range result.Fragments {
+				fmt.Printf(" Fragment %d: %d blocks", i+1, f.Blocks)
+				if f.Index >= 0 {
+					fmt.Printf(" starting at block %d", f.Index)
+				}
+				if f.Tail {
+					fmt.Print(", end of partition")
+				}
+				if f.Dangling {
+					fmt.Print(", following block missing")
+				}
+				fmt.Println()
+			}
+			fmt.Print("Enter rebuild to rebuild the partition, export to save its data to a file or nothing to abort: ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+			case "rebuild":
+				partition, err := result.Rebuild()
+				if err != nil {
+					fmt.Println("Error rebuilding partition: " + err.Error())
+					continue scanloop
+				}
+				path := expose(partition)
+				fmt.Printf("Successfully rebuilt partition. Exposed as %s!\n", path)
+			case "export":
+				fmt.Print("Enter path: ")
+				if !scanner.Scan() {
+					break scanloop
+				}
+				f, err := os.Create(scanner.Text())
+				if err != nil {
+					fmt.Println("Error creating file: " + err.Error())
+					continue scanloop
+				}
+				n, err := result.Export(f)
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					fmt.Println("Error exporting data: " + err.Error())
+					continue scanloop
+				}
+				fmt.Printf("Successfully exported %s.\n", ByteSizeToHumanReadable(n))
+			}
+		case "createredundant":
+			fmt.Print("Enter disk num: ")
+			state, disk := getSingleDisk(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			_, err := disk.GetPartition(pw)
+			if err == nil || err == rubberhose.ErrRedundancyDegraded {
+				fmt.Println("A partition with this password already exists!")
+				continue scanloop
+			}
+			fmt.Print("Enter block count: ")
+			if !scanner.Scan() {
+				break scanloop
+			}
+			blockCount, err := strconv.Atoi(scanner.Text())
+			if err != nil {
+				fmt.Println("Error parsing block count: " + err.Error())
+				continue scanloop
+			}
+			state, copies := getCopies(scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			partition, err := disk.WriteRedundantPartition(pw, int64(blockCount), copies)
+			if err != nil {
+				fmt.Println("Error writing redundant partition: " + err.Error())
+				continue scanloop
+			}
+			path := expose(partition)
+			fmt.Printf("Success! Redundant partition exposed as %s!\n", path)
+		case "addredundant", "repair":
+			fmt.Print("Enter disk num: ")
+			state, disk := getSingleDisk(disks, scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			password := ""
+			pw := getPassword(&password, false)
+			state, copies := getCopies(scanner)
+			switch state {
+			case Break:
+				break scanloop
+			case Continue:
+				continue scanloop
+			}
+			var partition *rubberhose.Partition
+			var err error
+			if cmd == "repair" {
+				partition, err = disk.RepairRedundantPartition(pw, copies)
+			} else {
+				partition, err = disk.GetRedundantPartition(pw, copies)
+			}
+			if err == rubberhose.ErrRedundancyDegraded {
+				fmt.Println("Warning: some copies of the partition are damaged. Use repair to restore them.")
+			} else if err != nil {
+				fmt.Println("Error opening redundant partition: " + err.Error())
+				continue scanloop
+			}
+			path := expose(partition)
+			fmt.Printf("Success! Partition exposed as %s! Blockcount: %d, Total Size: %s\n", path, partition.GetBlockCount(), ByteSizeToHumanReadable(partition.GetDataSize()))
+		}
+	}
+	for _, partition := range exposed {
+		if err := partition.Close(); err != nil {
+			fmt.Println("Error flushing partition: " + err.Error())
 		}
 	}
 }
 
-type ReturnState int
-
-const (
-	Break ReturnState = iota
-	Continue
-	Nothing
+var (
+	exposed []*rubberhose.Partition
+	servers = map[string]*rubberhose.NBDServer{}
 )
 
-func getPartition(disks []*rubberhose.Disk, scanner *bufio.Scanner, ignoreInvalidBlockStructure bool) (ReturnState, *rubberhose.Partition) {
+// expose exposes the partition and remembers it so its buffered writes can be flushed on exit.
+func expose(partition *rubberhose.Partition) string {
+	export, err := partition.ExportWith(&rubberhose.KernelExporter{})
+	if err != nil {
+		fmt.Println("Error exposing partition: " + err.Error())
+		return ""
+	}
+	go func() {
+		if err := export.Wait(); err != nil {
+			fmt.Println("Error exposing partition: " + err.Error())
+		}
+	}()
+	exposed = append(exposed, partition)
+	return export.Path()
+}
+
+func getMirrorDisks(disks []*rubberhose.Disk, scanner *bufio.Scanner) (ReturnState, *rubberhose.Disk, *rubberhose.Disk) {
 	fmt.Print("Enter disk num: ")
+	state, disk := getSingleDisk(disks, scanner)
+	if state != Nothing {
+		return state, nil, nil
+	}
+	fmt.Print("Enter mirror disk num: ")
+	state, mirror := getSingleDisk(disks, scanner)
+	if state != Nothing {
+		return state, nil, nil
+	}
+	return Nothing, disk, mirror
+}
+
+func getCopies(scanner *bufio.Scanner) (ReturnState, int) {
+	fmt.Print("Enter number of copies: ")
+	if !scanner.Scan() {
+		return Break, 0
+	}
+	copies, err := strconv.Atoi(scanner.Text())
+	if err != nil {
+		fmt.Println("Error parsing number of copies: " + err.Error())
+		return Continue, 0
+	}
+	return Nothing, copies
+}
+
+func getSingleDisk(disks []*rubberhose.Disk, scanner *bufio.Scanner) (ReturnState, *rubberhose.Disk) {
 	if !scanner.Scan() {
 		return Break, nil
 	}
@@ -345,22 +1368,92 @@ func getPartition(disks []*rubberhose.Disk, scanner *bufio.Scanner, ignoreInvali
 		fmt.Println("Error parsing disk num: " + err.Error())
 		return Continue, nil
 	}
-	if diskNum > len(disks) {
+	if diskNum < 1 || diskNum > len(disks) {
 		fmt.Println("Invalid disk num")
 		return Continue, nil
 	}
-	diskNum--
-	disk := disks[diskNum]
+	return Nothing, disks[diskNum-1]
+}
+
+type ReturnState int
+
+const (
+	Break ReturnState = iota
+	Continue
+	Nothing
+)
+
+func getPartition(disks []*rubberhose.Disk, scanner *bufio.Scanner, ignoreInvalidBlockStructure bool) (ReturnState, *rubberhose.Partition) {
+	state, disk := getDisk(disks, scanner)
+	if state != Nothing {
+		return state, nil
+	}
 	password := ""
 	pw := getPassword(&password, false)
-	partition, err := disk.GetPartition(pw)
-	if err != nil && !(err == rubberhose.ErrInvalidBlockStructure && ignoreInvalidBlockStructure) {
+	var partition *rubberhose.Partition
+	var err error
+	if d, ok := disk.(*rubberhose.Disk); ok {
+		bar := newProgressBar(os.Stdout, "Searching")
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		partition, err = d.GetPartitionContext(ctx, pw, bar.Report)
+		stop()
+		bar.Finish()
+	} else {
+		partition, err = disk.GetPartition(pw)
+	}
+	if err == rubberhose.ErrRedundancyDegraded {
+		fmt.Println("Warning: some copies of the partition are damaged. Use repair to restore them.")
+	} else if err != nil && !(err == rubberhose.ErrInvalidBlockStructure && ignoreInvalidBlockStructure) {
 		fmt.Println("Error opening partition: " + err.Error())
 		return Continue, nil
 	}
 	return Nothing, partition
 }
 
+type partitionStore interface {
+	GetPartition(password string) (*rubberhose.Partition, error)
+	WritePartition(password string, blockCount int64) (*rubberhose.Partition, error)
+}
+
+var pools = map[string]*rubberhose.Pool{}
+
+func getDisk(disks []*rubberhose.Disk, scanner *bufio.Scanner) (ReturnState, partitionStore) {
+	fmt.Print("Enter disk num (separate multiple with commas): ")
+	if !scanner.Scan() {
+		return Break, nil
+	}
+	var selected []*rubberhose.Disk
+	var nums []string
+	for _, field := range strings.Split(scanner.Text(), ",") {
+		field = strings.TrimSpace(field)
+		diskNum, err := strconv.Atoi(field)
+		if err != nil {
+			fmt.Println("Error parsing disk num: " + err.Error())
+			return Continue, nil
+		}
+		if diskNum < 1 || diskNum > len(disks) {
+			fmt.Println("Invalid disk num")
+			return Continue, nil
+		}
+		selected = append(selected, disks[diskNum-1])
+		nums = append(nums, field)
+	}
+	if len(selected) == 1 {
+		return Nothing, selected[0]
+	}
+	poolKey := strings.Join(nums, ",")
+	if pool, ok := pools[poolKey]; ok {
+		return Nothing, pool
+	}
+	pool, err := rubberhose.NewPool(selected...)
+	if err != nil {
+		fmt.Println("Error creating pool: " + err.Error())
+		return Continue, nil
+	}
+	pools[poolKey] = pool
+	return Nothing, pool
+}
+
 func ByteSizeToHumanReadable(size int64) string {
 	const unit = 1000
 	if size < unit {
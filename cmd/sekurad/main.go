@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	rubberhose "github.com/Cookie04DE/RubberHose"
 )
@@ -18,9 +23,24 @@ const (
 	pidPath  string = "/run/sekura.pid"
 )
 
-var disks = make(map[string]rubberhose.Disk)
+var (
+	disks    = make(map[string]*rubberhose.Disk) //Each path is opened once, either read-only or writable
+	servers  = make(map[string]*rubberhose.NBDServer)
+	diskLock sync.RWMutex
+	mapLock  sync.Mutex //Guards the maps above, requests that only read hold diskLock for reading
+)
 
 func main() {
+	coverInterval := flag.Duration("cover", 0, "Rewrite random blocks of the disks this often to hide which blocks are in use (e.g. 30s), 0 disables it. "+
+		"WARNING: blocks of partitions that aren't added to the daemon are destroyed, requires -acceptdataloss")
+	acceptDataLoss := flag.Bool("acceptdataloss", false, "Confirms that -cover destroys partitions that aren't added to the daemon")
+	coverBlocks := flag.Int("coverblocks", 16, "Number of blocks per disk rewritten each time")
+	shuffleInterval := flag.Duration("shuffle", 0, "Move blocks of the added partitions to new positions this often (e.g. 24h), 0 disables it")
+	shuffleFraction := flag.Float64("shufflefraction", 0.1, "Fraction of the blocks of each partition moved each time")
+	flag.Parse()
+	if *coverInterval > 0 && !*acceptDataLoss {
+		log.Fatal("-cover destroys partitions that aren't added to the daemon, add -acceptdataloss to confirm")
+	}
 	if _, err := os.Stat(pidPath); err == nil {
 		log.Fatal("Pid file already exists")
 	}
@@ -33,13 +53,19 @@ func main() {
 	if err != nil {
 		log.Fatal("Error opening socket: " + err.Error())
 	}
-	sigC := make(chan os.Signal)
+	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		<-sigC
 		ln.Close()
 	}()
 	rubberhose.RegisterGob()
+	if *coverInterval > 0 {
+		go coverTraffic(*coverInterval, *coverBlocks)
+	}
+	if *shuffleInterval > 0 {
+		go shufflePartitions(*shuffleInterval, *shuffleFraction)
+	}
 	for {
 		if func() bool {
 			conn, err := ln.Accept()
@@ -53,78 +79,14 @@ func main() {
 				defer conn.Close()
 				d := gob.NewDecoder(conn)
 				e := gob.NewEncoder(conn)
-			outer:
 				for {
 					request := &rubberhose.Request{}
 					err := d.Decode(request)
 					if err != nil {
 						break
 					}
-					switch request.ID {
-					default:
-						break outer
-					case rubberhose.AddRequestID:
-						ar := request.Data.(*rubberhose.AddRequest)
-						dp := ar.DiskPath
-						disk, ok := disks[dp]
-						if !ok {
-							d, err := rubberhose.NewDisk(dp)
-							if err != nil {
-								err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
-								if err != nil {
-									break outer
-								}
-								break
-							}
-							disk = *d
-							disks[dp] = disk
-						}
-						partition, err := disk.GetPartition(ar.Password)
-						if err != nil {
-							err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
-							if err != nil {
-								break outer
-							}
-							break
-						}
-						devicePath, _ := partition.Expose()
-						err = e.Encode(&rubberhose.AddResponse{DevicePath: devicePath})
-						if err != nil {
-							break outer
-						}
-					case rubberhose.DeleteRequestID:
-						dr := request.Data.(*rubberhose.DeleteRequest)
-						dp := dr.DiskPath
-						disk, ok := disks[dp]
-						if !ok {
-							d, err := rubberhose.NewDisk(dp)
-							if err != nil {
-								err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
-								if err != nil {
-									break outer
-								}
-								break
-							}
-							disk = *d
-							disks[dp] = disk
-						}
-						partition, err := disk.GetPartition(dr.Password)
-						if err != nil {
-							err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
-							if err != nil {
-								break outer
-							}
-							break
-						}
-						err = partition.Delete()
-						errstring := ""
-						if err != nil {
-							errstring = err.Error()
-						}
-						err = e.Encode(&rubberhose.DeleteResponse{Error: errstring})
-						if err != nil {
-							break outer
-						}
+					if !handleRequest(request, e) {
+						break
 					}
 				}
 			}()
@@ -133,4 +95,369 @@ func main() {
 			break
 		}
 	}
+	for path, disk := range disks {
+		if err := disk.Close(); err != nil {
+			log.Println("Error closing disk " + path + ": " + err.Error())
+		}
+	}
+}
+
+// handleRequest answers a request of a client, it returns false if the connection should be closed.
+func handleRequest(request *rubberhose.Request, enc *gob.Encoder) bool {
+	if request.ID == rubberhose.InfoRequestID || request.ID == rubberhose.ListRequestID {
+		diskLock.RLock() //Keeps the cover traffic from changing the disks while they are used
+		defer diskLock.RUnlock()
+	} else {
+		diskLock.Lock() //Requests changing the disks run alone, e.g. two allocations of the same free block would clash
+		defer diskLock.Unlock()
+	}
+	e := &responseEncoder{Encoder: enc, progress: request.Progress}
+	switch request.ID {
+	default:
+		return false
+	case rubberhose.AddRequestID:
+		ar := request.Data.(*rubberhose.AddRequest)
+		disk, err := getDisk(ar.DiskPath, ar.ReadOnly)
+		if err != nil {
+			err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		partition, err := disk.GetPartitionContext(context.Background(), ar.Password, e.progressFunc("Searching"))
+		if err != nil && err != rubberhose.ErrRedundancyDegraded {
+			err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		var exporter rubberhose.Exporter = &rubberhose.KernelExporter{}
+		if ar.Address != "" {
+			server, err := getServer(ar.Address)
+			if err != nil {
+				err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
+				if err != nil {
+					return false
+				}
+				break
+			}
+			exporter = &rubberhose.NetworkExporter{Server: server, Name: ar.Name}
+		}
+		export, err := partition.ExportWith(exporter)
+		if err != nil {
+			err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		go func() {
+			if err := export.Wait(); err != nil {
+				log.Println("Error exporting partition: " + err.Error())
+			}
+		}()
+		err = e.Encode(&rubberhose.AddResponse{DevicePath: export.Path()})
+		if err != nil {
+			return false
+		}
+	case rubberhose.DeleteRequestID:
+		dr := request.Data.(*rubberhose.DeleteRequest)
+		disk, err := getDisk(dr.DiskPath, false)
+		if err != nil {
+			err := e.Encode(&rubberhose.DeleteResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		partition, err := disk.GetPartitionContext(context.Background(), dr.Password, e.progressFunc("Searching"))
+		if err != nil {
+			err := e.Encode(&rubberhose.AddResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		err = partition.DeleteContext(context.Background(), e.progressFunc("Deleting"))
+		errstring := ""
+		if err != nil {
+			errstring = err.Error()
+		}
+		err = e.Encode(&rubberhose.DeleteResponse{Error: errstring})
+		if err != nil {
+			return false
+		}
+	case rubberhose.ScrubRequestID:
+		sr := request.Data.(*rubberhose.ScrubRequest)
+		disk, err := getDisk(sr.DiskPath, false)
+		if err != nil {
+			err := e.Encode(&rubberhose.ScrubResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		var partition *rubberhose.Partition
+		if sr.Copies > 1 {
+			partition, err = disk.GetRedundantPartition(sr.Password, sr.Copies)
+		} else {
+			partition, err = disk.GetPartition(sr.Password)
+		}
+		if err != nil && err != rubberhose.ErrRedundancyDegraded {
+			err := e.Encode(&rubberhose.ScrubResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		response := &rubberhose.ScrubResponse{}
+		result, err := partition.Scrub()
+		if err != nil {
+			response.Error = err.Error()
+		} else {
+			response.BlocksChecked = result.BlocksChecked
+			response.Repaired = result.Repaired
+			response.Damaged = result.Damaged
+		}
+		err = e.Encode(response)
+		if err != nil {
+			return false
+		}
+	case rubberhose.InfoRequestID:
+		ir := request.Data.(*rubberhose.InfoRequest)
+		disk, temporary, err := getInfoDisk(ir.DiskPath)
+		if err != nil {
+			err := e.Encode(&rubberhose.InfoResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		if temporary {
+			defer disk.Close()
+		}
+		partition, err := disk.GetPartition(ir.Password)
+		if err != nil && err != rubberhose.ErrRedundancyDegraded {
+			err := e.Encode(&rubberhose.InfoResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		err = e.Encode(&rubberhose.InfoResponse{PartitionInfo: getPartitionInfo(ir.DiskPath, partition)})
+		if err != nil {
+			return false
+		}
+	case rubberhose.GrowRequestID:
+		gr := request.Data.(*rubberhose.GrowRequest)
+		response := &rubberhose.GrowResponse{}
+		disk, err := getDisk(gr.DiskPath, false)
+		if err == nil {
+			err = disk.Grow(gr.ExtraBlocks)
+		}
+		if err == nil {
+			response.BlockCount, err = disk.GetBlockCount()
+		}
+		if err != nil {
+			response.Error = err.Error()
+		}
+		err = e.Encode(response)
+		if err != nil {
+			return false
+		}
+	case rubberhose.ShrinkRequestID:
+		sr := request.Data.(*rubberhose.ShrinkRequest)
+		response := &rubberhose.ShrinkResponse{}
+		disk, err := getDisk(sr.DiskPath, false)
+		if err == nil {
+			err = disk.Shrink(sr.BlockCount, sr.Force, sr.Passwords...)
+		}
+		if err == nil {
+			response.BlockCount, err = disk.GetBlockCount()
+		}
+		if err != nil {
+			response.Error = err.Error()
+		}
+		err = e.Encode(response)
+		if err != nil {
+			return false
+		}
+	case rubberhose.ShuffleRequestID:
+		sr := request.Data.(*rubberhose.ShuffleRequest)
+		disk, err := getDisk(sr.DiskPath, false)
+		if err != nil {
+			err := e.Encode(&rubberhose.ShuffleResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		partition, err := disk.GetPartition(sr.Password)
+		if err != nil {
+			err := e.Encode(&rubberhose.ShuffleResponse{Error: err.Error()})
+			if err != nil {
+				return false
+			}
+			break
+		}
+		response := &rubberhose.ShuffleResponse{}
+		response.Moved, err = partition.Shuffle(sr.Fraction)
+		if err != nil {
+			response.Error = err.Error()
+		}
+		err = e.Encode(response)
+		if err != nil {
+			return false
+		}
+	case rubberhose.ListRequestID:
+		response := &rubberhose.ListResponse{}
+		mapLock.Lock()
+		for path, disk := range disks {
+			for _, partition := range disk.Partitions {
+				response.Partitions = append(response.Partitions, getPartitionInfo(path, partition))
+			}
+		}
+		mapLock.Unlock()
+		if err := e.Encode(response); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// responseEncoder sends the final ProgressUpdate before the response if the client asked for progress.
+type responseEncoder struct {
+	*gob.Encoder
+	progress bool
+	percent  int64
+}
+
+// progressFunc returns a Progress sending updates of the stage whenever the percentage changes
+// or nil if the client didn't ask for them.
+func (e *responseEncoder) progressFunc(stage string) rubberhose.Progress {
+	if !e.progress {
+		return nil
+	}
+	e.percent = -1
+	return func(done, total int64) {
+		percent := int64(100)
+		if total > 0 {
+			percent = done * 100 / total
+		}
+		if percent == e.percent {
+			return
+		}
+		e.percent = percent
+		e.Encoder.Encode(&rubberhose.ProgressUpdate{Stage: stage, Done: done, Total: total}) //Errors show up when sending the response
+	}
+}
+
+func (e *responseEncoder) Encode(v interface{}) error {
+	if e.progress {
+		e.progress = false
+		if err := e.Encoder.Encode(&rubberhose.ProgressUpdate{Final: true}); err != nil {
+			return err
+		}
+	}
+	return e.Encoder.Encode(v)
+}
+
+// coverTraffic rewrites blocks of the writable disks, see Disk.Rerandomize.
+func coverTraffic(interval time.Duration, blocks int) {
+	for range time.Tick(interval) {
+		diskLock.Lock()
+		for path, disk := range disks {
+			if disk.IsReadOnly() {
+				continue
+			}
+			if err := disk.Rerandomize(blocks); err != nil {
+				log.Println("Error rewriting blocks of " + path + ": " + err.Error())
+			}
+		}
+		diskLock.Unlock()
+	}
+}
+
+// shufflePartitions moves blocks of the partitions on the writable disks, see Partition.Shuffle.
+func shufflePartitions(interval time.Duration, fraction float64) {
+	for range time.Tick(interval) {
+		diskLock.Lock()
+		for path, disk := range disks {
+			if disk.IsReadOnly() {
+				continue
+			}
+			for _, partition := range disk.Partitions {
+				if _, err := partition.Shuffle(fraction); err != nil {
+					log.Println("Error shuffling partition on " + path + ": " + err.Error())
+				}
+			}
+		}
+		diskLock.Unlock()
+	}
+}
+
+func getPartitionInfo(diskPath string, partition *rubberhose.Partition) rubberhose.PartitionInfo {
+	info := rubberhose.PartitionInfo{DiskPath: diskPath, BlockCount: partition.GetBlockCount(), Size: partition.GetDataSize()}
+	if export := partition.GetExport(); export != nil {
+		info.DevicePath = export.Path()
+	}
+	if metadata, err := partition.GetMetadata(); err == nil {
+		info.Metadata = metadata
+	}
+	return info
+}
+
+func getServer(address string) (*rubberhose.NBDServer, error) {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+	if server, ok := servers[address]; ok {
+		return server, nil
+	}
+	server := rubberhose.NewNBDServer()
+	if _, err := server.Listen(address); err != nil {
+		return nil, err
+	}
+	servers[address] = server
+	return server, nil
+}
+
+// getDisk returns the disk opened at path, opening it if necessary.
+// Opening a path that is already open in the other mode fails, two Disks would keep separate lists of used blocks.
+func getDisk(path string, readOnly bool) (*rubberhose.Disk, error) {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+	if disk, ok := disks[path]; ok {
+		if disk.IsReadOnly() == readOnly {
+			return disk, nil
+		}
+		if disk.IsReadOnly() {
+			return nil, fmt.Errorf("%s is already open read-only", path)
+		}
+		return nil, fmt.Errorf("%s is already open for writing", path)
+	}
+	open := rubberhose.NewDisk
+	if readOnly {
+		open = rubberhose.NewDiskReadOnly
+	}
+	disk, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	disks[path] = disk
+	return disk, nil
+}
+
+// getInfoDisk returns the disk opened at path in either mode.
+// If the path isn't open it is opened read-only without keeping it open, temporary is true then.
+func getInfoDisk(path string) (disk *rubberhose.Disk, temporary bool, err error) {
+	mapLock.Lock()
+	disk, ok := disks[path]
+	mapLock.Unlock()
+	if ok {
+		return disk, false, nil
+	}
+	disk, err = rubberhose.NewDiskReadOnly(path)
+	return disk, true, err
 }
@@ -0,0 +1,120 @@
+package rubberhose
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// Rerandomize rewrites n randomly chosen blocks of the disk so that comparing snapshots of the disk doesn't
+// reveal which blocks are in use: free blocks are overwritten with random data and blocks of partitions opened
+// on the disk are moved to a random free block, which encrypts them with a new iv and wipes their old location.
+// Either way a changed block looks like any other.
+// Blocks of partitions that aren't opened look free and are overwritten, so only use this once all partitions
+// on the disk are opened. Blocks of pools and of partitions opened with GetMirroredPartition are left untouched.
+func (d *Disk) Rerandomize(n int) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	blockCount, err := d.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	owners := map[int64]blockOwner{}
+	for _, par := range d.Partitions {
+		if par.checkCopies() != nil {
+			continue //Its blocks look used but aren't moved
+		}
+		for _, chain := range par.chains() {
+			for _, b := range chain.blocks {
+				if b.Disk == d {
+					owners[b.num] = blockOwner{par, chain}
+				}
+			}
+		}
+	}
+	buf := make([]byte, blockSize)
+	for i := 0; i < n; i++ {
+		r, err := rand.Int(rand.Reader, big.NewInt(blockCount))
+		if err != nil {
+			return err
+		}
+		num := r.Int64()
+		if _, used := d.usedBlocks[num]; !used {
+			if _, err := rand.Read(buf); err != nil {
+				return err
+			}
+			if _, err := d.writeAt(buf, dataOffset+num*blockSize); err != nil {
+				return err
+			}
+			continue
+		}
+		owner, ok := owners[num]
+		if !ok {
+			continue
+		}
+		index := owner.chain.blockIndex(d, num)
+		if index < 0 {
+			continue
+		}
+		moved, err := owner.move(index)
+		if err != nil {
+			return err
+		}
+		if moved {
+			delete(owners, num)
+			owners[owner.chain.blocks[index].num] = owner
+		}
+	}
+	return d.Sync()
+}
+
+// blockOwner is the partition a block belongs to and the chain of it holding the block, e.g. its metadata.
+type blockOwner struct {
+	par   *Partition
+	chain *Partition
+}
+
+// move moves the i-th block of the chain to a random free block on the same disk and wipes the old one.
+// It reports false if the disk doesn't have enough free blocks, rewriting the block in place instead wouldn't be crash-safe.
+// I/O on the partition waits until the block is moved.
+func (o blockOwner) move(i int) (bool, error) {
+	o.par.mu.Lock()
+	defer o.par.mu.Unlock()
+	if o.chain != o.par {
+		o.chain.mu.Lock()
+		defer o.chain.mu.Unlock()
+	}
+	d := o.chain.blocks[i].Disk
+	free, err := d.getFreeBlockCount()
+	if err != nil {
+		return false, err
+	}
+	if free < 1 || len(o.chain.blocks) == 1 && free < 2 { //See moveBlock
+		return false, nil
+	}
+	blockCount, err := d.GetBlockCount()
+	if err != nil {
+		return false, err
+	}
+	if err := o.par.flushCache(); err != nil {
+		return false, err
+	}
+	if err := o.chain.flushCache(); err != nil {
+		return false, err
+	}
+	return true, o.chain.moveBlock(i, blockCount)
+}
+
+// blockIndex returns the index of the block with the given number on d or -1 if it isn't part of the partition.
+func (par *Partition) blockIndex(d *Disk, num int64) int {
+	for i, b := range par.blocks {
+		if b.Disk == d && b.num == num {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,67 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRerandomize(t *testing.T) {
+	blockSize := int64(rubberhose.MinBlockSize + 40)
+	s := rubberhose.NewMemoryStorage(0)
+	d := rubberhose.NewDiskFromStorage(s)
+	require.NoError(t, d.Write(blockSize, 12))
+	p, err := d.WritePartition("test", 4)
+	require.NoError(t, err)
+	m, err := rubberhose.NewMetadata("cover")
+	require.NoError(t, err)
+	require.NoError(t, p.SetMetadata(m))
+	single, err := d.WritePartition("single", 1)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("cover"), 30)
+	writeTestData(t, p, testBytes, 0)
+	_, err = single.WriteAt([]byte("one block"), 0)
+	require.NoError(t, err)
+	require.NoError(t, p.SetCache(1<<20, rubberhose.WriteBack))
+	_, err = p.WriteAt([]byte("buffered"), 0)
+	require.NoError(t, err)
+	size, err := s.Size()
+	require.NoError(t, err)
+	before := make([]byte, size)
+	_, err = s.ReadAt(before, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, d.Rerandomize(200))
+	after := make([]byte, size)
+	_, err = s.ReadAt(after, 0)
+	require.NoError(t, err)
+	for i := int64(0); i < 12; i++ {
+		off := 32 + i*blockSize
+		require.NotEqual(t, before[off:off+blockSize], after[off:off+blockSize], "block %d unchanged", i)
+	}
+	copy(testBytes, "buffered")
+	requireData(t, p, testBytes, 0)
+
+	d = rubberhose.NewDiskFromStorage(s)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	require.Equal(t, 4, p.GetBlockCount())
+	requireData(t, p, testBytes, 0)
+	m, err = p.GetMetadata()
+	require.NoError(t, err)
+	require.Equal(t, "cover", m.Label)
+	single, err = d.GetPartition("single")
+	require.NoError(t, err)
+	require.Equal(t, 1, single.GetBlockCount())
+	buf := make([]byte, 9)
+	_, err = single.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "one block", string(buf))
+
+	_, path := createTestDisk(t, blockSize, 4)
+	d, err = rubberhose.NewDiskReadOnly(path)
+	require.NoError(t, err)
+	require.ErrorIs(t, d.Rerandomize(1), rubberhose.ErrReadOnly)
+}
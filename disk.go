@@ -2,10 +2,13 @@ package rubberhose
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"math/big"
 	"os"
@@ -23,27 +26,100 @@ const (
 	saltOffset      = blockSizeOffset + blockSizeSize
 	saltSize        = 8
 	diskDataOffset  = saltOffset + saltSize
+	diskIDOffset    = diskDataOffset //The bytes before the first block hold an id assigned by setID
+	diskIDSize      = 2
+	diskIDTagSize   = dataOffset - diskIDOffset - diskIDSize //Tells an assigned id apart from random data
+
+	//Disks used to be filled from diskDataOffset on, so their last block ends this many bytes after the end of the file
+	shortLastBlock = dataOffset - diskDataOffset
 )
 
 type Disk struct {
-	*os.File
+	Storage
 	Partitions map[string]*Partition
 	usedBlocks map[int64]struct{}
+	id         uint16
+	writeHook  func() error //Called before every block write, used to simulate crashes in tests
+	readOnly   bool
 }
 
+// ErrReadOnly is returned when trying to modify a disk opened with NewDiskReadOnly or a partition on it.
+var ErrReadOnly = errors.New("disk is opened read-only")
+
 func NewDisk(path string) (*Disk, error) {
-	f, err := os.OpenFile(path, os.O_RDWR, 0755)
+	s, err := OpenStorage(path, os.O_RDWR)
 	if err != nil {
 		return nil, err
 	}
-	return NewDiskFromFile(f), nil
+	return NewDiskFromStorage(s), nil
 }
 
+// NewDiskInFile opens a disk stored in length bytes of the file or block device at path starting at offset.
+// See SectionStorage.
+func NewDiskInFile(path string, offset, length int64) (*Disk, error) {
+	s, err := OpenStorage(path, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	section, err := NewSectionStorage(s, offset, length)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return NewDiskFromStorage(section), nil
+}
+
+// NewDiskReadOnly opens the disk without write access. Partitions can be read but never modified,
+// not even to recover from an interrupted resize.
+func NewDiskReadOnly(path string) (*Disk, error) {
+	s, err := OpenStorage(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	d := NewDiskFromStorage(s)
+	d.readOnly = true
+	return d, nil
+}
+
+func (d *Disk) IsReadOnly() bool {
+	return d.readOnly
+}
+
+// NewDiskFromFile uses f as a BlockDeviceStorage if it is a block device and as a FileStorage otherwise.
 func NewDiskFromFile(f *os.File) *Disk {
-	return &Disk{File: f, usedBlocks: map[int64]struct{}{}, Partitions: map[string]*Partition{}}
+	if info, err := f.Stat(); err == nil && isBlockDevice(info) {
+		return NewDiskFromStorage(BlockDeviceStorage{File: f})
+	}
+	return NewDiskFromStorage(FileStorage{File: f})
+}
+
+func NewDiskFromStorage(s Storage) *Disk {
+	return &Disk{Storage: s, usedBlocks: map[int64]struct{}{}, Partitions: map[string]*Partition{}}
+}
+
+// Close flushes the buffered writes of all partitions opened on the disk and closes it.
+func (d *Disk) Close() error {
+	for _, par := range d.Partitions {
+		if err := par.Close(); err != nil {
+			return err
+		}
+	}
+	return d.Storage.Close()
 }
 
-func (d Disk) Verify() error {
+func (d *Disk) writeAt(p []byte, off int64) (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if d.writeHook != nil {
+		if err := d.writeHook(); err != nil {
+			return 0, err
+		}
+	}
+	return d.WriteAt(p, off)
+}
+
+func (d *Disk) Verify() error {
 	magic := make([]byte, diskMagicSize)
 	_, err := d.ReadAt(magic, diskMagicOffset)
 	if err != nil {
@@ -55,7 +131,7 @@ func (d Disk) Verify() error {
 	return nil
 }
 
-func (d Disk) GetBlockSize() (int64, error) {
+func (d *Disk) GetBlockSize() (int64, error) {
 	bs := make([]byte, blockSizeSize)
 	_, err := d.ReadAt(bs, blockSizeOffset)
 	if err != nil {
@@ -64,20 +140,75 @@ func (d Disk) GetBlockSize() (int64, error) {
 	return int64(binary.LittleEndian.Uint64(bs)), nil
 }
 
-func (d Disk) writeBlockSize(blockSize int64) error {
+func (d *Disk) writeBlockSize(blockSize int64) error {
 	bs := make([]byte, blockSizeSize)
 	binary.LittleEndian.PutUint64(bs, uint64(blockSize))
 	_, err := d.WriteAt(bs, blockSizeOffset)
 	return err
 }
 
-func (d Disk) getSalt() ([]byte, error) {
+func (d *Disk) getSalt() ([]byte, error) {
 	p := make([]byte, saltSize)
 	_, err := d.ReadAt(p[:saltSize], saltOffset)
 	return p, err
 }
 
-func (d Disk) Write(blockSize, blockCount int64) error {
+// GetID returns the identifier other disks use to reference blocks on this disk.
+// It is derived from the salt unless the disk was assigned another one because of a collision in a pool
+// (see Pool.AddDisk).
+func (d *Disk) GetID() (uint16, error) {
+	if d.id != 0 {
+		return d.id, nil
+	}
+	salt, err := d.getSalt()
+	if err != nil {
+		return 0, err
+	}
+	stored := make([]byte, diskIDSize+diskIDTagSize)
+	if _, err := d.ReadAt(stored, diskIDOffset); err != nil {
+		return 0, err
+	}
+	id := binary.LittleEndian.Uint16(stored)
+	if !hmac.Equal(stored[diskIDSize:], diskIDTag(salt, id)) {
+		sum := sha256.Sum256(salt)
+		id = binary.LittleEndian.Uint16(sum[:])
+		if id == 0 || id == maxDiskID {
+			id = 1
+		}
+	}
+	d.id = id
+	return id, nil
+}
+
+// setID stores a new id for the disk. Blocks on other disks referencing this one by its old id are lost.
+func (d *Disk) setID(id uint16) error {
+	salt, err := d.getSalt()
+	if err != nil {
+		return err
+	}
+	stored := make([]byte, diskIDSize, diskIDSize+diskIDTagSize)
+	binary.LittleEndian.PutUint16(stored, id)
+	if _, err := d.writeAt(append(stored, diskIDTag(salt, id)...), diskIDOffset); err != nil {
+		return err
+	}
+	d.id = id
+	return d.Sync()
+}
+
+func diskIDTag(salt []byte, id uint16) []byte {
+	return deriveKey(salt, fmt.Sprintf("disk id %d", id))[:diskIDTagSize]
+}
+
+func (d *Disk) Write(blockSize, blockCount int64) error {
+	return d.WriteContext(context.Background(), blockSize, blockCount, nil)
+}
+
+// WriteContext works like Write and reports how many bytes of random data have been written.
+// If ctx is done, filling the disk stops and ctx.Err() is returned, the disk is unusable then.
+func (d *Disk) WriteContext(ctx context.Context, blockSize, blockCount int64, progress Progress) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
 	_, err := d.WriteAt(StartingMagic, diskMagicOffset)
 	if err != nil {
 		return err
@@ -95,16 +226,36 @@ func (d Disk) Write(blockSize, blockCount int64) error {
 	if err != nil {
 		return err
 	}
-	_, err = d.Seek(diskDataOffset, 0)
+	d.id = 0
+	return d.fillRandom(ctx, diskDataOffset, dataOffset-diskDataOffset+blockCount*blockSize, progress) //Blocks start at dataOffset
+}
+
+// WriteFull works like Write but uses all the space of the storage for blocks.
+func (d *Disk) WriteFull(blockSize int64) error {
+	return d.WriteFullContext(context.Background(), blockSize, nil)
+}
+
+// WriteFullContext works like WriteFull and reports the progress like WriteContext.
+func (d *Disk) WriteFullContext(ctx context.Context, blockSize int64, progress Progress) error {
+	size, err := d.Size()
 	if err != nil {
 		return err
 	}
-	_, err = io.CopyN(d.File, rand.Reader, blockCount*blockSize)
-	return err
+	blockCount := (size - dataOffset) / blockSize
+	if blockCount < 1 {
+		return fmt.Errorf("%d bytes are too small for a disk with a block size of %d", size, blockSize)
+	}
+	return d.WriteContext(ctx, blockSize, blockCount, progress)
+}
+
+// IsBlockDevice reports whether the disk is stored directly on a block device.
+func (d *Disk) IsBlockDevice() bool {
+	_, ok := d.Storage.(BlockDeviceStorage)
+	return ok
 }
 
-func (d Disk) GetBlockCount() (int64, error) {
-	info, err := d.Stat()
+func (d *Disk) GetBlockCount() (int64, error) {
+	size, err := d.Size()
 	if err != nil {
 		return 0, err
 	}
@@ -112,18 +263,42 @@ func (d Disk) GetBlockCount() (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	return (info.Size()-dataOffset)/blockSize + 1, nil
+	count := (size - dataOffset) / blockSize
+	if _, ok := d.Storage.(ResizableStorage); ok && (size-dataOffset)%blockSize >= blockSize-shortLastBlock {
+		count++ //The last block of a disk in the old layout, writing it grows the storage
+	}
+	return count, nil
 }
 
-func (d Disk) GetBlock(blockNum int64, key []byte) (*Block, error) {
+// completeLastBlock fills the missing end of the last block of a disk in the old layout with random data.
+func (d *Disk) completeLastBlock() error {
+	blockCount, err := d.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	size, err := d.Size()
+	if err != nil {
+		return err
+	}
+	if end := dataOffset + blockCount*blockSize; size < end {
+		return d.fillRandom(context.Background(), size, end-size, nil)
+	}
+	return nil
+}
+
+func (d *Disk) GetBlock(blockNum int64, key []byte) (*Block, error) {
 	blockSize, err := d.GetBlockSize()
 	if err != nil {
 		return nil, err
 	}
-	return NewBlock(&d, key, dataOffset, blockNum, blockSize)
+	return NewBlock(d, key, dataOffset, blockNum, blockSize)
 }
 
-func (d Disk) getKey(password string) ([]byte, error) {
+func (d *Disk) getKey(password string) ([]byte, error) {
 	salt, err := d.getSalt()
 	if err != nil {
 		return nil, err
@@ -131,7 +306,22 @@ func (d Disk) getKey(password string) ([]byte, error) {
 	return scrypt.Key([]byte(password), salt, 32768, 8, 1, 32)
 }
 
-func (d Disk) GetPartition(password string) (*Partition, error) {
+// deriveKey derives an independent key for the given purpose, e.g. for a redundant copy of a partition.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// GetPartition opens the partition with the given password. Partitions created by WriteRedundantPartition are opened
+// with all their copies and can be returned together with ErrRedundancyDegraded, see GetRedundantPartition.
+func (d *Disk) GetPartition(password string) (*Partition, error) {
+	return d.GetPartitionContext(context.Background(), password, nil)
+}
+
+// GetPartitionContext works like GetPartition and reports how many bytes of the disk have been searched.
+// If ctx is done, the search stops and ctx.Err() is returned.
+func (d *Disk) GetPartitionContext(ctx context.Context, password string, progress Progress) (*Partition, error) {
 	if par, ok := d.Partitions[password]; ok {
 		return par, nil
 	}
@@ -139,72 +329,190 @@ func (d Disk) GetPartition(password string) (*Partition, error) {
 	if err != nil {
 		return nil, err
 	}
-	var blocks []*Block
+	part, err := d.getPartitionContext(ctx, key, progress)
+	if part != nil {
+		d.Partitions[password] = part
+	}
+	return part, err
+}
+
+var ErrNoPartition = errors.New("no partition with that password")
+
+func (d *Disk) getPartition(key []byte) (*Partition, error) {
+	return d.getPartitionContext(context.Background(), key, nil)
+}
+
+// getPartitionContext opens the partition with the given key. If its blocks record copies, the other copies are searched
+// as well and the partition is opened like by GetRedundantPartition.
+func (d *Disk) getPartitionContext(ctx context.Context, key []byte, progress Progress) (*Partition, error) {
+	found, err := d.scanChainsContext(ctx, progress, key, metadataKey(key))
+	if err != nil {
+		return nil, err
+	}
+	copies, err := recordedCopies(found[0])
+	if err != nil {
+		return nil, err
+	}
+	if copies < 2 {
+		par, err := d.partitionFromBlocks(key, found[0])
+		if err != nil {
+			return nil, err
+		}
+		par.metadata = d.metadataFromBlocks(key, found[1])
+		return par, nil
+	}
+	keys := copyKeys(key, copies)
+	others, err := d.scanChainsContext(ctx, progress, keys[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	par, _, err := d.redundantPartition(keys, append([][]*Block{found[0]}, others...))
+	if par != nil {
+		par.metadata = d.metadataFromBlocks(key, found[1])
+	}
+	return par, err
+}
+
+// metadataFromBlocks returns the partition holding the metadata or nil if it is missing or broken.
+func (d *Disk) metadataFromBlocks(key []byte, blocks []*Block) *Partition {
+	meta, err := d.partitionFromBlocks(metadataKey(key), blocks)
+	if err != nil {
+		return nil
+	}
+	return meta
+}
+
+func (d *Disk) partitionFromBlocks(key []byte, blocks []*Block) (*Partition, error) {
+	if len(blocks) == 0 {
+		return nil, ErrNoPartition
+	}
+	part, err := d.newPartition(key, blocks)
+	if err != nil {
+		return nil, err
+	}
+	return part, part.orderBlocks()
+}
+
+// scanBlocks returns the blocks that are valid under each of the keys, checking all keys in a single pass over the disk.
+func (d *Disk) scanBlocks(keys ...[]byte) ([][]*Block, error) {
+	return d.scanBlocksContext(context.Background(), nil, keys...)
+}
+
+// scanBlocksContext works like scanBlocks, stops once ctx is done and reports the progress in bytes of the scanned blocks.
+func (d *Disk) scanBlocksContext(ctx context.Context, progress Progress, keys ...[]byte) ([][]*Block, error) {
+	found := make([][]*Block, len(keys))
 	blockCount, err := d.GetBlockCount()
 	if err != nil {
 		return nil, err
 	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return nil, err
+	}
 	for i := int64(0); i < blockCount; i++ {
-		b, err := d.GetBlock(i, key)
-		if err != nil {
+		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		if b.Validate() == nil {
-			blocks = append(blocks, b)
-			d.usedBlocks[i] = struct{}{}
+		if progress != nil {
+			progress(i*blockSize, blockCount*blockSize)
+		}
+		for k, key := range keys {
+			b, err := d.GetBlock(i, key)
+			if err != nil {
+				return nil, err
+			}
+			if tagged, err := b.validate(); err == nil {
+				b.tagged = tagged
+				found[k] = append(found[k], b)
+				d.usedBlocks[i] = struct{}{}
+				break
+			}
 		}
 	}
-	if len(blocks) == 0 {
-		return nil, errors.New("no partition with that password")
+	if progress != nil {
+		progress(blockCount*blockSize, blockCount*blockSize)
 	}
+	return found, nil
+}
+
+func (d *Disk) newPartition(key []byte, blocks []*Block) (*Partition, error) {
 	blockSize, err := d.GetBlockSize()
 	if err != nil {
 		return nil, err
 	}
-	part := &Partition{blockSize: blockSize, blocks: blocks, Disk: &d, key: key}
-	err = part.orderBlocks()
-	d.Partitions[password] = part
-	return part, err
+	tagged := len(blocks) == 0 || blocks[0].tagged //New partitions are tagged
+	for _, b := range blocks {
+		if b.tagged != tagged {
+			return nil, ErrInvalidBlockStructure
+		}
+	}
+	dataSize := blockSize - dataOffset
+	if tagged {
+		dataSize = blockSize - taggedDataOffset
+	}
+	return &Partition{blockSize: dataSize, blocks: blocks, Disk: d, key: key, tagged: tagged}, nil
 }
 
-func (d Disk) WritePartition(password string, blockCount int64) (*Partition, error) {
+// taggedDataSize returns the number of data bytes in each block of a new partition.
+func (d *Disk) taggedDataSize() (int64, error) {
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return 0, err
+	}
+	return blockSize - taggedDataOffset, nil
+}
+
+func (d *Disk) WritePartition(password string, blockCount int64) (*Partition, error) {
 	if par, ok := d.Partitions[password]; ok {
 		return par, nil
 	}
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
 	key, err := d.getKey(password)
 	if err != nil {
 		return nil, err
 	}
-	var lastBlock *Block
+	par, err := d.writePartition(key, blockCount, 0)
+	if err != nil {
+		return nil, err
+	}
+	d.Partitions[password] = par
+	return par, nil
+}
+
+// writePartition creates a chain of blockCount blocks under key, copies is recorded in the blocks of redundant partitions.
+func (d *Disk) writePartition(key []byte, blockCount int64, copies int) (*Partition, error) {
+	if blockCount < 1 {
+		return nil, errors.New("a partition needs at least one block")
+	}
 	blocks := make([]*Block, 0, blockCount)
 	for i := int64(0); i < blockCount; i++ {
 		block, err := d.allocateBlock(key)
 		if err != nil {
 			return nil, err
 		}
-		if lastBlock != nil {
-			err = lastBlock.Write(block.num)
-			if err != nil {
-				return nil, err
-			}
-		}
-		lastBlock = block
 		blocks = append(blocks, block)
 	}
-	err = blocks[len(blocks)-1].Write(-1)
+	par, err := d.newPartition(key, nil)
 	if err != nil {
 		return nil, err
 	}
-	blockSize, err := d.GetBlockSize()
+	par.copies = copies
+	return par, par.appendBlocks(blocks)
+}
+
+func (d *Disk) getFreeBlockCount() (int64, error) {
+	blocksOnDisk, err := d.GetBlockCount()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	par := &Partition{blockSize: blockSize, blocks: blocks, Disk: &d, key: key}
-	d.Partitions[password] = par
-	return par, nil
+	return blocksOnDisk - int64(len(d.usedBlocks)), nil
 }
 
-func (d Disk) allocateBlock(key []byte) (*Block, error) {
+var ErrAllBlocksAllocated = errors.New("all blocks allocated")
+
+func (d *Disk) allocateBlock(key []byte) (*Block, error) {
 	blocksOnDisk, err := d.GetBlockCount()
 	if err != nil {
 		return nil, err
@@ -213,7 +521,7 @@ func (d Disk) allocateBlock(key []byte) (*Block, error) {
 	var blockID int64
 	for true {
 		if len(d.usedBlocks) == int(blocksOnDisk) {
-			return nil, errors.New("all blocks allocated")
+			return nil, ErrAllBlocksAllocated
 		}
 		r, err := rand.Int(rand.Reader, bigBlocksOnDisk)
 		if err != nil {
@@ -225,6 +533,11 @@ func (d Disk) allocateBlock(key []byte) (*Block, error) {
 			break
 		}
 	}
+	if blockID == blocksOnDisk-1 {
+		if err := d.completeLastBlock(); err != nil {
+			return nil, err
+		}
+	}
 	d.usedBlocks[blockID] = struct{}{}
 	return d.GetBlock(blockID, key)
 }
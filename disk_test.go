@@ -1,6 +1,9 @@
 package rubberhose_test
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"os"
 	"testing"
 
@@ -9,10 +12,8 @@ import (
 )
 
 func TestDisk(t *testing.T) {
-	f, err := os.CreateTemp("", "")
-	require.NoError(t, err)
-	d := rubberhose.NewDiskFromFile(f)
-	err = d.Write(rubberhose.MinBlockSize+10, 10)
+	d := rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(0))
+	err := d.Write(rubberhose.MinBlockSize+10, 10)
 	require.NoError(t, err)
 	testPass := "test"
 	_, err = d.GetPartition(testPass)
@@ -29,3 +30,75 @@ func TestDisk(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, string(testBytes), string(readBytes))
 }
+
+func TestReadOnlyDisk(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	testPass := "test"
+	p, err := d.WritePartition(testPass, 2)
+	require.NoError(t, err)
+	testBytes := []byte("Read only data")
+	writeTestData(t, p, testBytes, 0)
+	crashAfter(d, 8) //The grow is committed but the new blocks aren't moved to the partition yet
+	require.Error(t, p.Resize(4))
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	d, err = rubberhose.NewDiskReadOnly(path)
+	require.NoError(t, err)
+	require.True(t, d.IsReadOnly())
+	p, err = d.GetPartition(testPass)
+	require.NoError(t, err)
+	require.True(t, p.IsReadOnly())
+	require.Equal(t, 4, p.GetBlockCount())
+	requireData(t, p, testBytes, 0)
+	_, err = p.WriteAt(testBytes, 0)
+	require.ErrorIs(t, err, rubberhose.ErrReadOnly)
+	require.ErrorIs(t, p.Resize(5), rubberhose.ErrReadOnly)
+	require.ErrorIs(t, p.Delete(), rubberhose.ErrReadOnly)
+	_, err = p.Scrub()
+	require.ErrorIs(t, err, rubberhose.ErrReadOnly)
+	_, err = d.WritePartition("other", 1)
+	require.ErrorIs(t, err, rubberhose.ErrReadOnly)
+	require.NoError(t, d.Close())
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+// TestOldLayout opens a disk as it was written before blocks were padded to their full size:
+// the random data started right after the salt, so the last block ended 12 bytes after the end of the file.
+func TestOldLayout(t *testing.T) {
+	blockSize, blockCount := int64(rubberhose.MinBlockSize+10), int64(4)
+	image := make([]byte, 20+blockCount*blockSize)
+	_, err := rand.Read(image)
+	require.NoError(t, err)
+	copy(image, rubberhose.StartingMagic)
+	binary.LittleEndian.PutUint64(image[4:], uint64(blockSize))
+	s := rubberhose.NewMemoryStorage(0)
+	writeTestData(t, s, image, 0)
+
+	d := rubberhose.NewDiskFromStorage(s)
+	require.NoError(t, d.Verify())
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, blockCount, count)
+	p, err := d.WritePartition("test", blockCount)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("0123456789"), int(blockCount))
+	writeTestData(t, p, testBytes, 0)
+	size, err := s.Size()
+	require.NoError(t, err)
+	require.Equal(t, 32+blockCount*blockSize, size)
+
+	d = rubberhose.NewDiskFromStorage(s)
+	count, err = d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, blockCount, count)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+	require.NoError(t, d.Grow(1))
+	count, err = d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, blockCount+1, count)
+}
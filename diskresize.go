@@ -0,0 +1,246 @@
+package rubberhose
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var errFixedSize = errors.New("the size of the disk's storage can't be changed")
+
+// ErrUnownedBlocks is returned by Shrink if used blocks beyond the new end belong to no partition opened on the disk,
+// e.g. to a pool.
+var ErrUnownedBlocks = errors.New("used blocks beyond the new end belong to no partition opened on the disk")
+
+func (d *Disk) resizableStorage() (ResizableStorage, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	s, ok := d.Storage.(ResizableStorage)
+	if !ok {
+		return nil, errFixedSize
+	}
+	return s, nil
+}
+
+// Grow appends extraBlocks blocks of random data to the disk, which can then be allocated to partitions.
+func (d *Disk) Grow(extraBlocks int64) error {
+	if _, err := d.resizableStorage(); err != nil {
+		return err
+	}
+	if extraBlocks < 1 {
+		return errors.New("a disk has to grow by at least one block")
+	}
+	blockCount, err := d.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	if err := d.completeLastBlock(); err != nil {
+		return err
+	}
+	if err := d.fillRandom(context.Background(), dataOffset+blockCount*blockSize, extraBlocks*blockSize, nil); err != nil {
+		return err
+	}
+	return d.Sync()
+}
+
+// Shrink cuts the disk down to blockCount blocks. Blocks of the partitions opened on the disk and of the partitions with
+// the given passwords are moved below the cut-off first. Partitions whose password isn't given are lost if any of their
+// blocks are cut off, just like when creating a partition while they aren't added.
+// Copies of redundant partitions that miss blocks have to be repaired first (see GetRedundantPartition).
+// Blocks of pools aren't moved, if other used blocks would be cut off ErrUnownedBlocks is returned unless force is set.
+func (d *Disk) Shrink(blockCount int64, force bool, passwords ...string) error {
+	s, err := d.resizableStorage()
+	if err != nil {
+		return err
+	}
+	if blockCount < 1 {
+		return errors.New("a disk needs at least one block")
+	}
+	oldCount, err := d.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	if blockCount > oldCount {
+		return fmt.Errorf("disk only has %d blocks, use Grow to add blocks", oldCount)
+	}
+	for _, password := range passwords {
+		if _, err := d.GetPartition(password); err != nil {
+			return err
+		}
+	}
+	var chains []*Partition
+	for _, par := range d.Partitions {
+		if err := par.checkCopies(); err != nil {
+			return err
+		}
+		chains = append(chains, par.chains()...)
+	}
+	var toMove, usedBelow int64
+	owned := map[int64]struct{}{}
+	for _, par := range chains {
+		for _, b := range par.blocks {
+			if b.Disk == d && b.num >= blockCount {
+				owned[b.num] = struct{}{}
+				toMove++
+				if len(par.blocks) == 1 {
+					toMove++ //See moveBlock
+				}
+			}
+		}
+	}
+	for num := range d.usedBlocks {
+		if num < blockCount {
+			usedBelow++
+		} else if _, ok := owned[num]; !ok && !force {
+			return ErrUnownedBlocks
+		}
+	}
+	if toMove > blockCount-usedBelow {
+		return fmt.Errorf("the partitions need %d more blocks than the disk would have", toMove-(blockCount-usedBelow))
+	}
+	for _, par := range chains {
+		if err := par.flushCache(); err != nil {
+			return err
+		}
+		for i := 0; i < len(par.blocks); i++ {
+			if b := par.blocks[i]; b.Disk == d && b.num >= blockCount {
+				if err := par.moveBlock(i, blockCount); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	if err := s.Truncate(dataOffset + blockCount*blockSize); err != nil {
+		return err
+	}
+	for num := range d.usedBlocks {
+		if num >= blockCount {
+			delete(d.usedBlocks, num)
+		}
+	}
+	return d.Sync()
+}
+
+// chains returns the partition and all partitions holding its copies and metadata.
+func (par *Partition) chains() []*Partition {
+	chains := []*Partition{par}
+	if par.metadata != nil {
+		chains = append(chains, par.metadata)
+	}
+	for _, r := range par.replicas {
+		chains = append(chains, r.chains()...)
+	}
+	return chains
+}
+
+// allocateBlockBelow works like allocateBlock but only uses blocks with a number below limit.
+func (d *Disk) allocateBlockBelow(key []byte, limit int64) (*Block, error) {
+	var used int64
+	for num := range d.usedBlocks {
+		if num < limit {
+			used++
+		}
+	}
+	if used >= limit {
+		return nil, ErrAllBlocksAllocated
+	}
+	for {
+		r, err := rand.Int(rand.Reader, big.NewInt(limit))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := d.usedBlocks[r.Int64()]; !ok {
+			if err := d.completeLastBlock(); err != nil {
+				return nil, err
+			}
+			d.usedBlocks[r.Int64()] = struct{}{}
+			return d.GetBlock(r.Int64(), key)
+		}
+	}
+}
+
+// moveBlock moves the i-th block to a free block below limit on the same disk.
+// The data is copied to the new block under the pending key, then the change is committed by pointing the previous
+// block to the new one, or by wiping the old block if it is the first one (see recoverChain).
+// Partitions consisting of a single block temporarily get a second block, which remains if the move is interrupted.
+func (par *Partition) moveBlock(i int, limit int64) error {
+	old := par.blocks[i]
+	d := old.Disk
+	key := par.keyFor(d)
+	if len(par.blocks) == 1 {
+		extra, err := d.allocateBlockBelow(key, limit)
+		if err != nil {
+			return err
+		}
+		if err := par.appendBlocks([]*Block{extra}); err != nil {
+			return err
+		}
+		if err := par.moveBlock(0, limit); err != nil {
+			return err
+		}
+		return par.truncateBlocks(1)
+	}
+	next, err := nextRef(par.blocks, i)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, old.GetDataSize())
+	if _, err := old.ReadAt(data, 0); err != nil {
+		return err
+	}
+	if i > 0 {
+		if old, err = old.rekey(pendingKey(key), next); err != nil { //Opening the partition restores it as long as the previous block points to it
+			return err
+		}
+	}
+	pending, err := d.allocateBlockBelow(pendingKey(key), limit)
+	if err != nil {
+		return err
+	}
+	moved, err := pending.withKey(key) //The header is written under the pending key, the data under the partition's key
+	if err != nil {
+		return err
+	}
+	moved.tagged, moved.index, moved.copies = par.tagged, int64(i), par.copies
+	if _, err := moved.WriteAt(data, 0); err != nil {
+		return err
+	}
+	if err := moved.Write(next); err != nil {
+		return err
+	}
+	if err := syncBlocks([]*Block{moved}); err != nil {
+		return err
+	}
+	if i > 0 {
+		err = par.linkBlocks(par.blocks[i-1], moved)
+	} else {
+		err = old.Delete()
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncBlocks([]*Block{moved}); err != nil {
+		return err
+	}
+	if moved, err = moved.rekey(key, next); err != nil {
+		return err
+	}
+	if i > 0 {
+		if err := old.Delete(); err != nil {
+			return err
+		}
+	}
+	par.blocks[i] = moved
+	return syncBlocks([]*Block{moved})
+}
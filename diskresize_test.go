@@ -0,0 +1,94 @@
+package rubberhose_test
+
+import (
+	"os"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskResize(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+100, 5)
+	filler, err := d.WritePartition("filler", 5)
+	require.NoError(t, err)
+	require.NoError(t, d.Grow(5))
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), count)
+	p, err := d.WritePartition("test", 3) //Only blocks 5 to 9 are free
+	require.NoError(t, err)
+	testBytes := []byte("Moved to the front of the disk")
+	writeTestData(t, p, testBytes, 250)
+	m, err := rubberhose.NewMetadata("moved")
+	require.NoError(t, err)
+	require.NoError(t, p.SetMetadata(m))
+	require.NoError(t, p.Sync())
+	require.NoError(t, filler.Delete())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	require.Error(t, d.Shrink(11, false))
+	require.Error(t, d.Shrink(4, false, "test"))
+	require.NoError(t, d.Shrink(5, false, "test"))
+	count, err = d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), count)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(32+5*(rubberhose.MinBlockSize+100)), info.Size())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	require.Equal(t, 3, p.GetBlockCount())
+	requireData(t, p, testBytes, 250)
+	readMetadata, err := p.GetMetadata()
+	require.NoError(t, err)
+	require.Equal(t, m, readMetadata)
+}
+
+func TestShrinkSingleBlock(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 2)
+	filler, err := d.WritePartition("filler", 2)
+	require.NoError(t, err)
+	require.NoError(t, d.Grow(1))
+	p, err := d.WritePartition("test", 1) //Has to use the last block
+	require.NoError(t, err)
+	testBytes := []byte("Only block")
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, filler.Delete())
+	require.NoError(t, d.Shrink(2, false))
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	require.Equal(t, 1, p.GetBlockCount())
+	requireData(t, p, testBytes, 0)
+}
+
+func TestShrinkUnownedBlocks(t *testing.T) {
+	var disks []*rubberhose.Disk
+	for i := 0; i < 2; i++ {
+		d := rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(0))
+		require.NoError(t, d.Write(rubberhose.MinBlockSize+10, 4))
+		disks = append(disks, d)
+	}
+	pool, err := rubberhose.NewPool(disks...)
+	require.NoError(t, err)
+	_, err = pool.WritePartition("pooled", 8) //Uses every block of both disks
+	require.NoError(t, err)
+	require.Equal(t, rubberhose.ErrUnownedBlocks, disks[0].Shrink(2, false))
+	count, err := disks[0].GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), count)
+	require.NoError(t, disks[0].Shrink(2, true))
+	count, err = disks[0].GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+}
@@ -0,0 +1,32 @@
+package rubberhose
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A SizeDetector determines the size of the block device a disk is stored on.
+type SizeDetector interface {
+	Size(f *os.File) (int64, error)
+}
+
+// DefaultSizeDetector is used by block device storages without a SizeDetector.
+// It asks the kernel for the size of the device, the file size of a block device is always zero.
+var DefaultSizeDetector SizeDetector = ioctlSizeDetector{}
+
+type ioctlSizeDetector struct{}
+
+func (ioctlSizeDetector) Size(f *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, fmt.Errorf("error reading size of block device: %v", errno)
+	}
+	return int64(size), nil
+}
+
+func isBlockDevice(info os.FileInfo) bool {
+	return info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
@@ -0,0 +1,37 @@
+package rubberhose_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedSize int64
+
+func (s fixedSize) Size(*os.File) (int64, error) {
+	return int64(s), nil
+}
+
+func TestSizeDetector(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(3000)) //Like a device, the space exists before the disk is written
+	d := rubberhose.NewDiskFromStorage(rubberhose.BlockDeviceStorage{File: f, SizeDetector: fixedSize(1560)})
+	require.True(t, d.IsBlockDevice())
+	require.NoError(t, d.WriteFull(rubberhose.MinBlockSize+10))
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(23), count)
+	_, err = d.WritePartition("test", 23)
+	require.NoError(t, err)
+	_, err = d.WritePartition("other", 1)
+	require.Equal(t, rubberhose.ErrAllBlocksAllocated, err)
+	require.Error(t, d.Grow(1))
+
+	d = rubberhose.NewDiskFromStorage(rubberhose.BlockDeviceStorage{File: f, SizeDetector: fixedSize(40)})
+	require.Error(t, d.WriteFull(rubberhose.MinBlockSize+10))
+}
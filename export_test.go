@@ -0,0 +1,30 @@
+package rubberhose
+
+func SetWriteHook(d *Disk, hook func() error) {
+	d.writeHook = hook
+}
+
+// CorruptData flips a bit of the data of the i-th block of a copy of the partition (0 is the partition itself)
+// without touching its header.
+func CorruptData(par *Partition, copy, i int) error {
+	b := copyOf(par, copy).blocks[i]
+	buf := make([]byte, 1)
+	if _, err := b.Storage.ReadAt(buf, b.offset+b.dataStart()); err != nil {
+		return err
+	}
+	buf[0] ^= 1
+	_, err := b.Storage.WriteAt(buf, b.offset+b.dataStart())
+	return err
+}
+
+// DamageBlock overwrites the i-th block of a copy of the partition with random data.
+func DamageBlock(par *Partition, copy, i int) error {
+	return copyOf(par, copy).blocks[i].Delete()
+}
+
+func copyOf(par *Partition, copy int) *Partition {
+	if copy > 0 {
+		return par.replicas[copy-1]
+	}
+	return par
+}
@@ -0,0 +1,135 @@
+package rubberhose
+
+import (
+	"fmt"
+	"sync"
+)
+
+// An Exporter makes partitions available to other programs, e.g. as a block device or over the network.
+type Exporter interface {
+	Export(par *Partition) (Export, error)
+}
+
+// An Export is a partition made available by an Exporter.
+type Export interface {
+	// Path describes where the partition can be found, e.g. the path of the block device.
+	Path() string
+	// Wait blocks until the export stopped and returns the error that stopped it, if any.
+	Wait() error
+	// Close stops the export. Closing an export more than once has no effect.
+	Close() error
+}
+
+// ExportWith exports the partition using e, a previous export of the partition is closed first.
+// Exported partitions buffer their writes in a cache of DefaultWriteBuffer bytes unless a cache was set.
+func (par *Partition) ExportWith(e Exporter) (Export, error) {
+	if err := par.Unexport(); err != nil {
+		return nil, err
+	}
+	if par.cache == nil {
+		if err := par.SetCache(DefaultWriteBuffer, WriteBack); err != nil {
+			return nil, err
+		}
+	}
+	export, err := e.Export(par)
+	if err != nil {
+		return nil, err
+	}
+	par.export = export
+	return export, nil
+}
+
+// GetExport returns the current export of the partition or nil if it isn't exported.
+func (par *Partition) GetExport() Export {
+	return par.export
+}
+
+// Unexport closes the current export of the partition, if any.
+func (par *Partition) Unexport() error {
+	if par.export == nil {
+		return nil
+	}
+	export := par.export
+	par.export = nil
+	return export.Close()
+}
+
+// exportState implements the lifecycle shared by all exports.
+type exportState struct {
+	path    string
+	done    chan struct{}
+	once    sync.Once
+	err     error
+	onClose func() error
+}
+
+func newExportState(path string, onClose func() error) *exportState {
+	return &exportState{path: path, done: make(chan struct{}), onClose: onClose}
+}
+
+func (s *exportState) Path() string {
+	return s.path
+}
+
+func (s *exportState) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// stop ends the export with err. Only the first call has an effect.
+func (s *exportState) stop(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+func (s *exportState) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	err := s.onClose()
+	s.stop(nil)
+	return err
+}
+
+// NetworkExporter exports partitions through an NBDServer under the given name.
+type NetworkExporter struct {
+	Server *NBDServer
+	Name   string
+}
+
+func (e *NetworkExporter) Export(par *Partition) (Export, error) {
+	e.Server.AddExport(e.Name, par)
+	return newExportState(e.Name, func() error {
+		e.Server.RemoveExport(e.Name)
+		return nil
+	}), nil
+}
+
+// MemoryExporter keeps track of exported partitions without making them available to anyone.
+// It is meant for tests and doesn't require root permissions.
+type MemoryExporter struct {
+	mu      sync.Mutex
+	count   int
+	Exports map[string]*Partition
+}
+
+func (e *MemoryExporter) Export(par *Partition) (Export, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Exports == nil {
+		e.Exports = map[string]*Partition{}
+	}
+	path := fmt.Sprintf("memory%d", e.count)
+	e.count++
+	e.Exports[path] = par
+	return newExportState(path, func() error {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.Exports, path)
+		return nil
+	}), nil
+}
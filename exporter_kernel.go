@@ -0,0 +1,118 @@
+package rubberhose
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dop251/buse"
+	"golang.org/x/sys/unix"
+)
+
+// KernelExporter exports partitions as nbd block devices using the nbd kernel module, which requires root permissions.
+// If Path is empty a free device is taken from Allocator, or from DefaultDeviceAllocator if that is nil.
+// The sysfs entries of the device are looked up below the allocator's Root.
+type KernelExporter struct {
+	Path      string
+	Allocator *DeviceAllocator
+}
+
+func (e *KernelExporter) Export(par *Partition) (Export, error) {
+	allocator := e.Allocator
+	if allocator == nil {
+		allocator = DefaultDeviceAllocator
+	}
+	if e.Path != "" {
+		return exportDevice(par, e.Path, allocator, func() {})
+	}
+	var failed []string
+	var exportErr error //The first error that isn't caused by another process taking the device
+	defer func() {
+		for _, path := range failed {
+			allocator.Release(path)
+		}
+	}()
+	for {
+		path, err := allocator.Allocate()
+		if err == ErrNoFreeDevice && exportErr != nil {
+			return nil, exportErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		export, err := exportDevice(par, path, allocator, func() { allocator.Release(path) })
+		if err != nil {
+			failed = append(failed, path) //Kept allocated until we are done so it isn't tried again
+			if exportErr == nil && !errors.Is(err, unix.EBUSY) {
+				exportErr = err
+			}
+			continue
+		}
+		return export, nil
+	}
+}
+
+func exportDevice(par *Partition, path string, allocator *DeviceAllocator, releaseDevice func()) (Export, error) {
+	bd, err := buse.NewDevice(path, par.GetDataSize(), par)
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	release := func() { once.Do(releaseDevice) } //The device may already be allocated again when the second call happens
+	export := newExportState(path, func() error {
+		bd.Disconnect()
+		release()
+		return nil
+	})
+	go func() {
+		err := bd.Run()
+		if err != nil {
+			err = fmt.Errorf("error running nbd device %s: %v", path, err)
+		}
+		release()
+		export.stop(err)
+	}()
+	if par.IsReadOnly() {
+		go markReadOnly(path, allocator.pidPath(filepath.Base(path)))
+	}
+	return export, nil
+}
+
+// Expose exports the partition as the first available nbd device and returns its path.
+func (par *Partition) Expose() (string, error) {
+	export, err := par.ExportWith(&KernelExporter{})
+	if err != nil {
+		return "", err
+	}
+	return export.Path(), nil
+}
+
+func (par *Partition) ExposePath(path string) (Export, error) {
+	return par.ExportWith(&KernelExporter{Path: path})
+}
+
+// markReadOnly marks the nbd device read-only once the kernel connected it.
+// Writes would fail anyway, but this way the kernel refuses them and tools like mount notice.
+// pidPath is the device's pid file below the allocator's Root, it only exists while the device is connected.
+func markReadOnly(path, pidPath string) {
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(pidPath); err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println("Error marking device read-only: ", err)
+			return
+		}
+		defer f.Close()
+		if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.BLKROSET, 1); err != nil {
+			log.Println("Error marking device read-only: ", err)
+		}
+		return
+	}
+}
@@ -0,0 +1,43 @@
+package rubberhose_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporter(t *testing.T) {
+	d, _ := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	p, err := d.WritePartition("test", 4)
+	require.NoError(t, err)
+	memory := &rubberhose.MemoryExporter{}
+	first, err := p.ExportWith(memory)
+	require.NoError(t, err)
+	require.Equal(t, first, p.GetExport())
+	require.Equal(t, map[string]*rubberhose.Partition{first.Path(): p}, memory.Exports)
+
+	second, err := p.ExportWith(memory)
+	require.NoError(t, err)
+	require.NoError(t, first.Wait())
+	require.NotEqual(t, first.Path(), second.Path())
+	require.Equal(t, map[string]*rubberhose.Partition{second.Path(): p}, memory.Exports)
+	require.NoError(t, p.Close())
+	require.NoError(t, second.Wait())
+	require.Nil(t, p.GetExport())
+	require.Empty(t, memory.Exports)
+	require.NoError(t, second.Close())
+
+	server := rubberhose.NewNBDServer()
+	ln, err := server.Listen(filepath.Join(t.TempDir(), "nbd.sock"))
+	require.NoError(t, err)
+	defer ln.Close()
+	export, err := p.ExportWith(&rubberhose.NetworkExporter{Server: server, Name: "test"})
+	require.NoError(t, err)
+	require.Equal(t, "test", export.Path())
+	c := dialNBD(t, "unix", ln.Addr().String())
+	require.Equal(t, []string{"test"}, c.list())
+	require.NoError(t, p.Delete())
+	require.Empty(t, c.list())
+}
@@ -0,0 +1,96 @@
+package rubberhose
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"runtime"
+	"sync"
+)
+
+const fillChunkSize = 4 << 20
+
+// FillWorkers is the number of goroutines filling disks with random data, zero means one per CPU.
+var FillWorkers = 0
+
+// fillRandom fills length bytes starting at off with random data.
+// The data is the AES-CTR key stream of a random key, which is much faster than reading crypto/rand and
+// indistinguishable from it. The counter is derived from the offset, so workers can fill disjoint chunks in any order.
+// Once ctx is done no more chunks are started and ctx.Err() is returned.
+func (d *Disk) fillRandom(ctx context.Context, off, length int64, progress Progress) error {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	workers := FillWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	chunks := make(chan int64)
+	errs := make(chan error, workers)
+	var mu sync.Mutex //Serializes progress reports
+	var done int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, fillChunkSize)
+			for start := range chunks {
+				chunk := buf
+				if remaining := length - start; int64(len(chunk)) > remaining {
+					chunk = chunk[:remaining]
+				}
+				for i := range chunk {
+					chunk[i] = 0
+				}
+				counter := make([]byte, len(iv))
+				copy(counter, iv)
+				IncrementIV(counter, start/aes.BlockSize)
+				cipher.NewCTR(c, counter).XORKeyStream(chunk, chunk)
+				if _, err := d.WriteAt(chunk, off+start); err != nil {
+					errs <- err
+					return
+				}
+				if progress != nil {
+					mu.Lock()
+					done += int64(len(chunk))
+					progress(done, length)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+send:
+	for start := int64(0); start < length; start += fillChunkSize {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		select {
+		case chunks <- start:
+		case err = <-errs:
+			break send
+		case <-ctx.Done():
+			err = ctx.Err()
+			break send
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStorage fails to write beyond the first MiB.
+type failingStorage struct {
+	rubberhose.Storage
+}
+
+func (s failingStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off >= 1<<20 {
+		return 0, errors.New("disk full")
+	}
+	return s.Storage.WriteAt(p, off)
+}
+
+func TestFill(t *testing.T) {
+	rubberhose.FillWorkers = 3
+	defer func() { rubberhose.FillWorkers = 0 }()
+	s := rubberhose.NewMemoryStorage(0)
+	d := rubberhose.NewDiskFromStorage(s)
+	blockSize := int64(1 << 20)
+	var last, total int64
+	require.NoError(t, d.WriteContext(context.Background(), blockSize, 10, func(done, n int64) {
+		if done <= last {
+			panic("progress went backwards")
+		}
+		last, total = done, n
+	}))
+	require.Equal(t, total, last)
+	size, err := s.Size()
+	require.NoError(t, err)
+	require.Equal(t, 32+10*blockSize, size)
+	require.Equal(t, size-20, total)
+	data := make([]byte, size)
+	_, err = s.ReadAt(data, 0)
+	require.NoError(t, err)
+	seen := map[string]bool{}
+	for off := 32; off+16 <= len(data); off += 16 { //The key stream never repeats
+		require.False(t, seen[string(data[off:off+16])])
+		seen[string(data[off:off+16])] = true
+	}
+	require.False(t, bytes.Equal(data[32:32+blockSize], data[32+blockSize:32+2*blockSize]))
+	p, err := d.WritePartition("test", 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, p.GetBlockCount())
+
+	d = rubberhose.NewDiskFromStorage(failingStorage{rubberhose.NewMemoryStorage(0)})
+	require.Error(t, d.Write(blockSize, 20))
+
+	s = rubberhose.NewMemoryStorage(0)
+	d = rubberhose.NewDiskFromStorage(s)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.ErrorIs(t, d.WriteContext(ctx, blockSize, 100, func(done, n int64) { cancel() }), context.Canceled)
+	size, err = s.Size()
+	require.NoError(t, err)
+	require.Less(t, size, 32+100*blockSize)
+}
+
+func BenchmarkFill(b *testing.B) {
+	const size = 64 << 20
+	for _, workers := range []int{1, 0} {
+		name := "parallel"
+		if workers == 1 {
+			name = "single"
+		}
+		b.Run(name, func(b *testing.B) {
+			rubberhose.FillWorkers = workers
+			defer func() { rubberhose.FillWorkers = 0 }()
+			d := rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(size))
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, d.Write(1<<20, size>>20-1))
+			}
+		})
+	}
+}
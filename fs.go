@@ -0,0 +1,619 @@
+package rubberhose
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	fsChunkSize       = 4096
+	fsMagic           = "SEKURAFS"
+	fsHeaderSize      = len(fsMagic) + 8 + 4
+	fsMaxIndexExtents = (fsChunkSize - fsHeaderSize) / 16
+)
+
+var (
+	ErrNoFileSystem = errors.New("partition doesn't contain a file system")
+	ErrNoSpace      = errors.New("no space left in file system")
+)
+
+// FS is a minimal file system stored inside a partition, usable without root permissions, the nbd module or mounting.
+// It implements io/fs.FS, ReadDirFS, ReadFileFS and StatFS and adds methods to modify it.
+//
+// The partition is divided into chunks of 4 KiB. The first chunk points to the index, a JSON encoded map of all
+// files and directories and the chunks holding their data. Every modification writes a new index to free chunks
+// and then replaces the pointer, so a crash leaves the file system in its old or its new state.
+// Data read from files that are replaced or removed while open is undefined.
+type FS struct {
+	mu      sync.Mutex
+	par     *Partition
+	entries map[string]*fsEntry
+	index   []fsExtent //Chunks holding the index
+	used    []bool
+}
+
+type fsExtent struct {
+	Start, Count int64
+}
+
+type fsEntry struct {
+	Dir     bool  `json:",omitempty"`
+	Size    int64 `json:",omitempty"`
+	ModTime time.Time
+	Extents []fsExtent `json:",omitempty"`
+}
+
+// FormatFS creates an empty file system on the partition, overwriting its contents.
+func FormatFS(par *Partition) (*FS, error) {
+	if par.IsReadOnly() {
+		return nil, ErrReadOnly
+	}
+	chunks := par.GetDataSize() / fsChunkSize
+	if chunks < 2 {
+		return nil, fmt.Errorf("a file system needs at least %d bytes", 2*fsChunkSize)
+	}
+	fsys := &FS{par: par, entries: map[string]*fsEntry{".": {Dir: true, ModTime: time.Now()}}, used: make([]bool, chunks)}
+	fsys.used[0] = true
+	if err := fsys.commit(); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// OpenFS opens the file system created by FormatFS on the partition.
+func OpenFS(par *Partition) (*FS, error) {
+	header := make([]byte, fsChunkSize)
+	if int64(len(header)) > par.GetDataSize() {
+		return nil, ErrNoFileSystem
+	}
+	if _, err := par.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(fsMagic)]) != fsMagic {
+		return nil, ErrNoFileSystem
+	}
+	fsys := &FS{par: par, used: make([]bool, par.GetDataSize()/fsChunkSize)}
+	fsys.used[0] = true
+	length := int64(binary.LittleEndian.Uint64(header[len(fsMagic):]))
+	count := int(binary.LittleEndian.Uint32(header[len(fsMagic)+8:]))
+	if count > fsMaxIndexExtents {
+		return nil, ErrNoFileSystem
+	}
+	for i := 0; i < count; i++ {
+		off := fsHeaderSize + i*16
+		fsys.index = append(fsys.index, fsExtent{
+			Start: int64(binary.LittleEndian.Uint64(header[off:])),
+			Count: int64(binary.LittleEndian.Uint64(header[off+8:])),
+		})
+	}
+	if err := fsys.markUsed(fsys.index); err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, length)
+	if err := fsys.readExtents(fsys.index, encoded, 0); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(encoded, &fsys.entries); err != nil {
+		return nil, fmt.Errorf("error decoding file system index: %v", err)
+	}
+	if root := fsys.entries["."]; root == nil || !root.Dir {
+		return nil, ErrNoFileSystem
+	}
+	for _, e := range fsys.entries {
+		if err := fsys.markUsed(e.Extents); err != nil {
+			return nil, err
+		}
+	}
+	return fsys, nil
+}
+
+func (fsys *FS) markUsed(extents []fsExtent) error {
+	for _, e := range extents {
+		if e.Start <= 0 || e.Count <= 0 || e.Start+e.Count > int64(len(fsys.used)) {
+			return ErrNoFileSystem
+		}
+		for i := e.Start; i < e.Start+e.Count; i++ {
+			fsys.used[i] = true
+		}
+	}
+	return nil
+}
+
+func (fsys *FS) free(extents []fsExtent) {
+	for _, e := range extents {
+		for i := e.Start; i < e.Start+e.Count; i++ {
+			fsys.used[i] = false
+		}
+	}
+}
+
+// allocate reserves a chunk, preferring the chunk at hint to keep files contiguous.
+func (fsys *FS) allocate(hint int64) (int64, error) {
+	if hint <= 0 || hint >= int64(len(fsys.used)) {
+		hint = 1
+	}
+	for i := hint; i < int64(len(fsys.used)); i++ {
+		if !fsys.used[i] {
+			fsys.used[i] = true
+			return i, nil
+		}
+	}
+	for i := int64(1); i < hint; i++ {
+		if !fsys.used[i] {
+			fsys.used[i] = true
+			return i, nil
+		}
+	}
+	return 0, ErrNoSpace
+}
+
+// appendChunk allocates another chunk and adds it to extents.
+func (fsys *FS) appendChunk(extents []fsExtent) ([]fsExtent, int64, error) {
+	var hint int64
+	if len(extents) > 0 {
+		last := extents[len(extents)-1]
+		hint = last.Start + last.Count
+	}
+	chunk, err := fsys.allocate(hint)
+	if err != nil {
+		return extents, 0, err
+	}
+	if len(extents) > 0 && chunk == hint {
+		extents[len(extents)-1].Count++
+		return extents, chunk, nil
+	}
+	return append(extents, fsExtent{Start: chunk, Count: 1}), chunk, nil
+}
+
+// readExtents reads len(p) bytes at off of the data stored in extents.
+func (fsys *FS) readExtents(extents []fsExtent, p []byte, off int64) error {
+	for _, e := range extents {
+		if len(p) == 0 {
+			return nil
+		}
+		length := e.Count * fsChunkSize
+		if off >= length {
+			off -= length
+			continue
+		}
+		n := length - off
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		if _, err := fsys.par.ReadAt(p[:n], e.Start*fsChunkSize+off); err != nil {
+			return err
+		}
+		p = p[n:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// commit writes the index to new chunks and points the header to them. The chunks of the old index are freed.
+func (fsys *FS) commit() error {
+	encoded, err := json.Marshal(fsys.entries)
+	if err != nil {
+		return err
+	}
+	var extents []fsExtent
+	for i := int64(0); i < int64(len(encoded)); i += fsChunkSize {
+		var chunk int64
+		extents, chunk, err = fsys.appendChunk(extents)
+		if err == nil && len(extents) > fsMaxIndexExtents {
+			err = errors.New("file system index too fragmented")
+		}
+		if err != nil {
+			fsys.free(extents)
+			return err
+		}
+		end := i + fsChunkSize
+		if end > int64(len(encoded)) {
+			end = int64(len(encoded))
+		}
+		if _, err := fsys.par.WriteAt(encoded[i:end], chunk*fsChunkSize); err != nil {
+			fsys.free(extents)
+			return err
+		}
+	}
+	header := make([]byte, fsHeaderSize+16*len(extents))
+	copy(header, fsMagic)
+	binary.LittleEndian.PutUint64(header[len(fsMagic):], uint64(len(encoded)))
+	binary.LittleEndian.PutUint32(header[len(fsMagic)+8:], uint32(len(extents)))
+	for i, e := range extents {
+		binary.LittleEndian.PutUint64(header[fsHeaderSize+i*16:], uint64(e.Start))
+		binary.LittleEndian.PutUint64(header[fsHeaderSize+i*16+8:], uint64(e.Count))
+	}
+	err = fsys.par.Sync()
+	if err == nil {
+		_, err = fsys.par.WriteAtFUA(header, 0)
+	}
+	if err != nil {
+		fsys.free(extents)
+		return err
+	}
+	fsys.free(fsys.index)
+	fsys.index = extents
+	return nil
+}
+
+// update sets the entry of name, or removes it if entry is nil, and commits. The entries are restored if committing fails.
+func (fsys *FS) update(name string, entry *fsEntry) error {
+	old, existed := fsys.entries[name]
+	if entry == nil {
+		delete(fsys.entries, name)
+	} else {
+		fsys.entries[name] = entry
+	}
+	if err := fsys.commit(); err != nil {
+		if existed {
+			fsys.entries[name] = old
+		} else {
+			delete(fsys.entries, name)
+		}
+		return err
+	}
+	if existed {
+		fsys.free(old.Extents)
+	}
+	return nil
+}
+
+// checkParent returns an error unless the parent directory of name exists.
+func (fsys *FS) checkParent(op, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if parent := fsys.entries[path.Dir(name)]; parent == nil || !parent.Dir {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e := fsys.entries[name]
+	if e == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f := &fsFile{fsys: fsys, info: fsFileInfo{name: path.Base(name), entry: *e}}
+	if e.Dir {
+		f.children = fsys.children(name)
+	}
+	return f, nil
+}
+
+func (fsys *FS) children(dir string) []fs.DirEntry {
+	var children []fs.DirEntry
+	for name, e := range fsys.entries {
+		if name != "." && path.Dir(name) == dir {
+			children = append(children, &fsFileInfo{name: path.Base(name), entry: *e})
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return children
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	e := fsys.entries[name]
+	if e == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !e.Dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.children(name), nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	e := fsys.entries[name]
+	if e == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &fsFileInfo{name: path.Base(name), entry: *e}, nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file := f.(*fsFile)
+	if file.info.entry.Dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	data := make([]byte, file.info.entry.Size)
+	if err := fsys.readExtents(file.info.entry.Extents, data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Space returns the number of free and total bytes available for data.
+func (fsys *FS) Space() (free, total int64) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	for _, used := range fsys.used[1:] {
+		if !used {
+			free += fsChunkSize
+		}
+	}
+	return free, int64(len(fsys.used)-1) * fsChunkSize
+}
+
+// Mkdir creates a directory, its parent has to exist.
+func (fsys *FS) Mkdir(name string) error {
+	if fsys.par.IsReadOnly() {
+		return ErrReadOnly
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if err := fsys.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	if fsys.entries[name] != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	return fsys.update(name, &fsEntry{Dir: true, ModTime: time.Now()})
+}
+
+// MkdirAll creates a directory and all missing parents.
+func (fsys *FS) MkdirAll(name string) error {
+	if name == "." {
+		return nil
+	}
+	if info, err := fsys.Stat(name); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return nil
+	}
+	if err := fsys.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	return fsys.Mkdir(name)
+}
+
+// Remove removes a file or an empty directory.
+func (fsys *FS) Remove(name string) error {
+	if fsys.par.IsReadOnly() {
+		return ErrReadOnly
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	e := fsys.entries[name]
+	if e == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if e.Dir && len(fsys.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	return fsys.update(name, nil)
+}
+
+// WriteFile creates or replaces the file with data.
+func (fsys *FS) WriteFile(name string, data []byte) error {
+	w, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Create returns a writer for a new file. The file appears, or replaces an existing file, once the writer is closed.
+func (fsys *FS) Create(name string) (io.WriteCloser, error) {
+	if fsys.par.IsReadOnly() {
+		return nil, ErrReadOnly
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if err := fsys.checkParent("create", name); err != nil {
+		return nil, err
+	}
+	if e := fsys.entries[name]; e != nil && e.Dir {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+	return &fsWriter{fsys: fsys, name: name, buf: make([]byte, 0, fsChunkSize)}, nil
+}
+
+type fsWriter struct {
+	fsys    *FS
+	name    string
+	extents []fsExtent
+	size    int64
+	buf     []byte
+	err     error
+}
+
+func (w *fsWriter) Write(p []byte) (int, error) {
+	written := 0
+	for w.err == nil && len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+	}
+	return written, w.err
+}
+
+// flush writes the buffered data to a new chunk. Errors are kept in w.err and free the chunks of the writer.
+func (w *fsWriter) flush() {
+	if w.err != nil || len(w.buf) == 0 {
+		return
+	}
+	w.fsys.mu.Lock()
+	var chunk int64
+	w.extents, chunk, w.err = w.fsys.appendChunk(w.extents)
+	w.fsys.mu.Unlock()
+	if w.err == nil {
+		_, w.err = w.fsys.par.WriteAt(w.buf, chunk*fsChunkSize)
+	}
+	if w.err != nil {
+		w.abort()
+		return
+	}
+	w.size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+}
+
+func (w *fsWriter) abort() {
+	w.fsys.mu.Lock()
+	defer w.fsys.mu.Unlock()
+	w.fsys.free(w.extents)
+	w.extents = nil
+}
+
+func (w *fsWriter) Close() error {
+	w.flush()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("writer already closed")
+	fsys := w.fsys
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	err := fsys.checkParent("create", w.name)
+	if e := fsys.entries[w.name]; err == nil && e != nil && e.Dir {
+		err = &fs.PathError{Op: "create", Path: w.name, Err: fs.ErrExist}
+	}
+	if err == nil {
+		err = fsys.update(w.name, &fsEntry{Size: w.size, ModTime: time.Now(), Extents: w.extents})
+	}
+	if err != nil {
+		fsys.free(w.extents)
+	}
+	return err
+}
+
+type fsFileInfo struct {
+	name  string
+	entry fsEntry
+}
+
+func (i *fsFileInfo) Name() string       { return i.name }
+func (i *fsFileInfo) Size() int64        { return i.entry.Size }
+func (i *fsFileInfo) ModTime() time.Time { return i.entry.ModTime }
+func (i *fsFileInfo) IsDir() bool        { return i.entry.Dir }
+func (i *fsFileInfo) Sys() interface{}   { return nil }
+func (i *fsFileInfo) Type() fs.FileMode  { return i.Mode().Type() }
+
+func (i *fsFileInfo) Mode() fs.FileMode {
+	if i.entry.Dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *fsFileInfo) Info() (fs.FileInfo, error) {
+	return i, nil
+}
+
+// fsFile is an open file or directory of an FS.
+type fsFile struct {
+	fsys     *FS
+	info     fsFileInfo
+	off      int64
+	children []fs.DirEntry
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return &f.info, nil
+}
+
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.info.entry.Dir {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.New("is a directory")}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	if off >= f.info.entry.Size {
+		return 0, io.EOF
+	}
+	var err error
+	if remaining := f.info.entry.Size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+	if readErr := f.fsys.readExtents(f.info.entry.Extents, p, off); readErr != nil {
+		return 0, readErr
+	}
+	return len(p), err
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.entry.Size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.entry.Dir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.name, Err: errors.New("not a directory")}
+	}
+	if n > 0 && len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(f.children) {
+		n = len(f.children)
+	}
+	entries := f.children[:n]
+	f.children = f.children[n:]
+	return entries, nil
+}
+
+func (f *fsFile) Close() error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+1024, 100)
+	p, err := d.WritePartition("test", 80)
+	require.NoError(t, err)
+	_, err = rubberhose.OpenFS(p)
+	require.Equal(t, rubberhose.ErrNoFileSystem, err)
+	fsys, err := rubberhose.FormatFS(p)
+	require.NoError(t, err)
+	free, total := fsys.Space()
+	require.Equal(t, int64(19*4096), total)
+	require.Equal(t, total-4096, free) //The index takes one chunk
+
+	large := bytes.Repeat([]byte("Spans multiple chunks. "), 1000)
+	require.NoError(t, fsys.WriteFile("hello.txt", []byte("Hello, World!")))
+	require.NoError(t, fsys.MkdirAll("docs/old"))
+	require.NoError(t, fsys.WriteFile("docs/large", large))
+	require.NoError(t, fsys.WriteFile("docs/old/empty", nil))
+	require.ErrorIs(t, fsys.WriteFile("missing/file", nil), fs.ErrNotExist)
+	require.ErrorIs(t, fsys.Mkdir("docs"), fs.ErrExist)
+	require.Error(t, fsys.Remove("docs"))
+
+	w, err := fsys.Create("streamed")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = w.Write(large[:1000])
+		require.NoError(t, err)
+	}
+	_, err = fsys.Stat("streamed")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.NoError(t, w.Close())
+	require.NoError(t, fstest.TestFS(fsys, "hello.txt", "docs/large", "docs/old/empty", "streamed"))
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	fsys, err = rubberhose.OpenFS(p)
+	require.NoError(t, err)
+	require.NoError(t, fstest.TestFS(fsys, "hello.txt", "docs/large", "docs/old/empty", "streamed"))
+	data, err := fsys.ReadFile("docs/large")
+	require.NoError(t, err)
+	require.Equal(t, large, data)
+	f, err := fsys.Open("streamed")
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat(large[:1000], 10), data)
+
+	free, _ = fsys.Space()
+	require.NoError(t, fsys.WriteFile("docs/large", []byte("small")))
+	require.NoError(t, fsys.Remove("streamed"))
+	afterRemove, _ := fsys.Space()
+	require.Greater(t, afterRemove, free)
+	require.ErrorIs(t, fsys.WriteFile("too large", make([]byte, total)), rubberhose.ErrNoSpace)
+	free, _ = fsys.Space()
+	require.Equal(t, afterRemove, free)
+}
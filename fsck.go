@@ -0,0 +1,254 @@
+package rubberhose
+
+import (
+	"io"
+	"sort"
+)
+
+// A Fragment is a consistent part of a partition's block chain.
+type Fragment struct {
+	Blocks   int
+	Tail     bool  //The fragment ends with the last block of the partition
+	Dangling bool  //The last block points to a block that is missing
+	Index    int64 //Position of the first block in the partition, -1 if the blocks don't store it
+	blocks   []*Block
+}
+
+// FsckResult describes the blocks of a damaged partition.
+// Fragments are ordered the way Rebuild and Export put them together: by the position stored in their blocks or, if
+// a fragment doesn't store it, the longest fragments first and the fragment containing the end of the partition last.
+type FsckResult struct {
+	Fragments []Fragment
+	disk      *Disk
+	password  string
+	key       []byte
+	blockSize int64
+}
+
+// Gaps returns the number of places where at least one block is missing.
+func (r *FsckResult) Gaps() int {
+	var gaps int
+	for i := range r.Fragments {
+		if r.missingBefore(i) > 0 {
+			gaps++
+		}
+	}
+	return gaps
+}
+
+// missingBefore returns the number of blocks missing in front of the i-th fragment.
+// It is one if the positions of the fragments aren't known, as the actual number is unknown.
+func (r *FsckResult) missingBefore(i int) int64 {
+	if i == 0 {
+		if r.Fragments[0].Index > 0 {
+			return r.Fragments[0].Index
+		}
+		return 0
+	}
+	prev, f := r.Fragments[i-1], r.Fragments[i]
+	if prev.Index < 0 || f.Index < 0 {
+		return 1
+	}
+	if missing := f.Index - prev.Index - int64(prev.Blocks); missing > 0 {
+		return missing
+	}
+	return 0
+}
+
+// Orphans returns the number of fragments consisting of a single block that doesn't end the partition.
+func (r *FsckResult) Orphans() int {
+	var orphans int
+	for _, f := range r.Fragments {
+		if f.Blocks == 1 && !f.Tail {
+			orphans++
+		}
+	}
+	return orphans
+}
+
+// Fsck finds all blocks that are valid under the password and reconstructs the longest chains they form.
+func (d *Disk) Fsck(password string) (*FsckResult, error) {
+	key, err := d.getKey(password)
+	if err != nil {
+		return nil, err
+	}
+	found, err := d.scanChains(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(found[0]) == 0 {
+		return nil, ErrNoPartition
+	}
+	par, err := d.newPartition(key, found[0])
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := findFragments(found[0])
+	if err != nil {
+		return nil, err
+	}
+	return &FsckResult{Fragments: fragments, disk: d, password: password, key: key, blockSize: par.blockSize}, nil
+}
+
+func findFragments(blocks []*Block) ([]Fragment, error) {
+	byNum := make(map[int64]*Block, len(blocks))
+	for _, b := range blocks {
+		byNum[b.num] = b
+	}
+	next := make(map[*Block]*Block, len(blocks))
+	hasPredecessor := make(map[*Block]bool, len(blocks))
+	tails := make(map[*Block]bool)
+	for _, b := range blocks {
+		id, err := b.GetNextBlockID()
+		if err != nil {
+			return nil, err
+		}
+		if id == -1 {
+			tails[b] = true
+			continue
+		}
+		candidate, ok := byNum[id&blockRefNumMask]
+		if !ok {
+			continue
+		}
+		pointsTo, err := b.pointsTo(candidate)
+		if err != nil {
+			return nil, err
+		}
+		if pointsTo && !hasPredecessor[candidate] {
+			next[b] = candidate
+			hasPredecessor[candidate] = true
+		}
+	}
+	visited := make(map[*Block]bool, len(blocks))
+	var fragments []Fragment
+	walk := func(start *Block) {
+		f := Fragment{}
+		for b := start; b != nil && !visited[b]; b = next[b] {
+			visited[b] = true
+			f.blocks = append(f.blocks, b)
+		}
+		last := f.blocks[len(f.blocks)-1]
+		f.Blocks = len(f.blocks)
+		f.Tail = tails[last]
+		f.Dangling = !f.Tail && next[last] == nil
+		fragments = append(fragments, f)
+	}
+	for _, b := range blocks {
+		if !hasPredecessor[b] {
+			walk(b)
+		}
+	}
+	for _, b := range blocks { //Whatever is left forms cycles
+		if !visited[b] {
+			walk(b)
+		}
+	}
+	indexed := true
+	for i := range fragments {
+		if err := fragments[i].findIndex(); err != nil {
+			return nil, err
+		}
+		indexed = indexed && fragments[i].Index >= 0
+	}
+	sort.SliceStable(fragments, func(i, j int) bool {
+		if indexed {
+			return fragments[i].Index < fragments[j].Index
+		}
+		if fragments[i].Tail != fragments[j].Tail {
+			return fragments[j].Tail
+		}
+		return fragments[i].Blocks > fragments[j].Blocks
+	})
+	return fragments, nil
+}
+
+// findIndex sets the position of the fragment from the first of its blocks whose tag checks out.
+func (f *Fragment) findIndex() error {
+	f.Index = -1
+	for i, b := range f.blocks {
+		if !b.tagged {
+			return nil
+		}
+		index, _, ok, err := b.readIndex()
+		if err != nil {
+			return err
+		}
+		if ok && index >= int64(i) {
+			f.Index = index - int64(i)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Rebuild links all fragments into a new, valid partition.
+// Zero filled blocks are inserted for the missing blocks: as many as are missing if the fragments store their
+// position, otherwise one for every gap. Blocks whose data doesn't match their tag keep failing it, so Scrub still
+// reports them.
+func (r *FsckResult) Rebuild() (*Partition, error) {
+	if r.disk.readOnly {
+		return nil, ErrReadOnly
+	}
+	var blocks, holes []*Block
+	for i, f := range r.Fragments {
+		for j := int64(0); j < r.missingBefore(i); j++ {
+			hole, err := r.disk.allocateBlock(r.key)
+			if err != nil {
+				return nil, err
+			}
+			hole.tagged = f.blocks[0].tagged
+			blocks = append(blocks, hole)
+			holes = append(holes, hole)
+		}
+		blocks = append(blocks, f.blocks...)
+	}
+	par, err := r.disk.newPartition(r.key, blocks)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range par.blocks {
+		if err := par.writeBlockHeader(i); err != nil {
+			return nil, err
+		}
+		if err := b.setIndex(int64(i)); err != nil {
+			return nil, err
+		}
+	}
+	zeros := make([]byte, r.blockSize)
+	for _, hole := range holes {
+		if _, err := hole.WriteAt(zeros, 0); err != nil {
+			return nil, err
+		}
+	}
+	r.disk.Partitions[r.password] = par
+	return par, par.Sync()
+}
+
+// Export writes the data of all fragments to w without modifying the disk.
+// Missing blocks are filled with zeros, matching the layout created by Rebuild.
+func (r *FsckResult) Export(w io.Writer) (int64, error) {
+	var written int64
+	buf := make([]byte, r.blockSize)
+	zeros := make([]byte, r.blockSize)
+	for i, f := range r.Fragments {
+		for j := int64(0); j < r.missingBefore(i); j++ {
+			n, err := w.Write(zeros)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		for _, b := range f.blocks {
+			if _, err := b.ReadAt(buf, 0); err != nil {
+				return written, err
+			}
+			n, err := w.Write(buf)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,88 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	const blockSize = rubberhose.MinBlockSize + 10
+	d, path := createTestDisk(t, blockSize, 8)
+	testPass := "test"
+	_, err := d.WritePartition(testPass, 8)
+	require.NoError(t, err)
+	garbage := make([]byte, blockSize)
+	_, err = rand.Read(garbage)
+	require.NoError(t, err)
+	_, err = d.WriteAt(garbage, 32+3*blockSize) //Blocks start at byte 32, every block belongs to the partition
+	require.NoError(t, err)
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	result, err := d.Fsck(testPass)
+	require.NoError(t, err)
+	var found int
+	for _, f := range result.Fragments {
+		found += f.Blocks
+	}
+	require.Equal(t, 7, found)
+	require.LessOrEqual(t, result.Gaps(), 1)
+
+	var exported bytes.Buffer
+	n, err := result.Export(&exported)
+	require.NoError(t, err)
+	require.Equal(t, int64((7+result.Gaps())*10), n)
+	require.Equal(t, int(n), exported.Len())
+
+	p, err := result.Rebuild()
+	require.NoError(t, err)
+	require.Equal(t, 7+result.Gaps(), p.GetBlockCount())
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition(testPass)
+	require.NoError(t, err)
+	require.Equal(t, 7+result.Gaps(), p.GetBlockCount())
+	rebuilt := make([]byte, exported.Len())
+	_, err = p.ReadAt(rebuilt, 0)
+	require.NoError(t, err)
+	require.Equal(t, exported.Bytes(), rebuilt)
+}
+
+func TestFsckPositions(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	testPass := "test"
+	p, err := d.WritePartition(testPass, 8)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("0123456789"), 8)
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, rubberhose.DamageBlock(p, 0, 3))
+	require.NoError(t, rubberhose.DamageBlock(p, 0, 4))
+	require.NoError(t, rubberhose.CorruptData(p, 0, 6))
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	result, err := d.Fsck(testPass)
+	require.NoError(t, err)
+	require.Len(t, result.Fragments, 2)
+	require.Equal(t, int64(0), result.Fragments[0].Index)
+	require.Equal(t, int64(5), result.Fragments[1].Index)
+	require.Equal(t, 1, result.Gaps())
+	expected := append([]byte{}, testBytes...)
+	copy(expected[30:50], make([]byte, 20)) //Both missing blocks are filled with zeros
+	var exported bytes.Buffer
+	_, err = result.Export(&exported)
+	require.NoError(t, err)
+	require.Equal(t, expected[:60], exported.Bytes()[:60])
+	require.Equal(t, expected[70:], exported.Bytes()[70:])
+
+	p, err = result.Rebuild()
+	require.NoError(t, err)
+	require.Equal(t, 8, p.GetBlockCount())
+	scrubbed, err := p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, []rubberhose.DamagedRange{{Offset: 60, Length: 10}}, scrubbed.Damaged) //Rebuilding doesn't hide damage
+}
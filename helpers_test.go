@@ -0,0 +1,33 @@
+package rubberhose_test
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestDisk(t *testing.T, blockSize, blockCount int64) (*rubberhose.Disk, string) {
+	f, err := os.CreateTemp("", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	d := rubberhose.NewDiskFromFile(f)
+	require.NoError(t, d.Write(blockSize, blockCount))
+	return d, f.Name()
+}
+
+// writeTestData writes data at off and fails the test if that doesn't succeed.
+func writeTestData(t *testing.T, w io.WriterAt, data []byte, off int64) {
+	_, err := w.WriteAt(data, off)
+	require.NoError(t, err)
+}
+
+// requireData fails the test unless data is stored at off.
+func requireData(t *testing.T, r io.ReaderAt, data []byte, off int64) {
+	buf := make([]byte, len(data))
+	_, err := r.ReadAt(buf, off)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
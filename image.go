@@ -0,0 +1,135 @@
+package rubberhose
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const imageBufferSize = 1 << 20
+
+// Progress is called with the number of bytes processed so far and the total number of bytes.
+// Long running disk and partition operations take it in their ...Context variant (e.g. Disk.WriteContext),
+// together with a context cancelling them, a nil Progress reports nothing.
+type Progress func(done, total int64)
+
+// ExportImage writes the decrypted data of the partition to w as a raw image and returns its SHA-256 checksum.
+func (par *Partition) ExportImage(w io.Writer, progress Progress) ([]byte, error) {
+	h := sha256.New()
+	if err := par.copyImage(io.MultiWriter(w, h), 0, par.GetDataSize(), progress); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyImage writes length bytes of the partition starting at off to w.
+func (par *Partition) copyImage(w io.Writer, off, length int64, progress Progress) error {
+	buf := make([]byte, imageBufferSize)
+	for done := int64(0); done < length; {
+		n := length - done
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if _, err := par.ReadAt(buf[:n], off+done); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		done += n
+		if progress != nil {
+			progress(done, length)
+		}
+	}
+	return nil
+}
+
+// ImportImage creates a partition just large enough for the size bytes of the raw image read from r and writes the image to it.
+// The rest of the last block is filled with zeros. The written data is read back and compared with the
+// SHA-256 checksum of the image, which is returned.
+func (d *Disk) ImportImage(password string, r io.Reader, size int64, progress Progress) (*Partition, []byte, error) {
+	if d.readOnly {
+		return nil, nil, ErrReadOnly
+	}
+	if size <= 0 {
+		return nil, nil, errors.New("empty image")
+	}
+	if _, ok := d.Partitions[password]; ok {
+		return nil, nil, errors.New("partition already added")
+	}
+	key, err := d.getKey(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := d.getPartition(key); err != ErrNoPartition {
+		if err == nil {
+			err = errors.New("a partition with this password already exists")
+		}
+		return nil, nil, err
+	}
+	dataSize, err := d.taggedDataSize()
+	if err != nil {
+		return nil, nil, err
+	}
+	par, err := d.writePartition(key, (size+dataSize-1)/dataSize, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.Partitions[password] = par
+	fail := func(err error) (*Partition, []byte, error) { //An incomplete image is of no use, so the partition is removed
+		delete(d.Partitions, password)
+		par.Delete()
+		return nil, nil, err
+	}
+	h := sha256.New()
+	buf := make([]byte, imageBufferSize)
+	for done := int64(0); done < par.GetDataSize(); {
+		chunk := buf
+		if remaining := par.GetDataSize() - done; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		var n int64
+		if done < size {
+			n = size - done
+			if n > int64(len(chunk)) {
+				n = int64(len(chunk))
+			}
+			if _, err := io.ReadFull(r, chunk[:n]); err != nil {
+				return fail(fmt.Errorf("error reading image: %v", err))
+			}
+			h.Write(chunk[:n])
+		}
+		for i := range chunk[n:] {
+			chunk[n+int64(i)] = 0
+		}
+		if _, err := par.WriteAt(chunk, done); err != nil {
+			return fail(err)
+		}
+		if progress != nil && n > 0 {
+			progress(done+n, size)
+		}
+		done += int64(len(chunk))
+	}
+	if err := par.Sync(); err != nil {
+		return fail(err)
+	}
+	checksum := h.Sum(nil)
+	return par, checksum, par.VerifyImage(checksum, size)
+}
+
+// VerifyImage checks that the first size bytes of the partition have the given SHA-256 checksum.
+func (par *Partition) VerifyImage(checksum []byte, size int64) error {
+	if size > par.GetDataSize() {
+		return errors.New("image larger than partition")
+	}
+	h := sha256.New()
+	if err := par.copyImage(h, 0, size, nil); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), checksum) {
+		return errors.New("checksum mismatch, the partition doesn't contain the image")
+	}
+	return nil
+}
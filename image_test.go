@@ -0,0 +1,56 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImage(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+100, 30)
+	image := make([]byte, 1234)
+	_, err := rand.Read(image)
+	require.NoError(t, err)
+	var done, total int64
+	p, checksum, err := d.ImportImage("test", bytes.NewReader(image), int64(len(image)), func(d, t int64) { done, total = d, t })
+	require.NoError(t, err)
+	sum := sha256.Sum256(image)
+	require.Equal(t, sum[:], checksum)
+	require.Equal(t, int64(len(image)), done)
+	require.Equal(t, int64(len(image)), total)
+	require.Equal(t, 13, p.GetBlockCount())
+	_, _, err = d.ImportImage("test", bytes.NewReader(image), int64(len(image)), nil)
+	require.Error(t, err)
+
+	d, err = rubberhose.NewDiskReadOnly(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	require.NoError(t, p.VerifyImage(checksum, int64(len(image))))
+	exported := &bytes.Buffer{}
+	checksum, err = p.ExportImage(exported, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1300), int64(exported.Len()))
+	require.Equal(t, image, exported.Bytes()[:len(image)])
+	require.Equal(t, make([]byte, 1300-len(image)), exported.Bytes()[len(image):])
+	sum = sha256.Sum256(exported.Bytes())
+	require.Equal(t, sum[:], checksum)
+	image[0]++
+	sum = sha256.Sum256(image)
+	require.Error(t, p.VerifyImage(sum[:], int64(len(image))))
+	_, _, err = d.ImportImage("other", bytes.NewReader(image), int64(len(image)), nil)
+	require.Equal(t, rubberhose.ErrReadOnly, err)
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	_, _, err = d.ImportImage("truncated", bytes.NewReader(image[:100]), int64(len(image)), nil)
+	require.Error(t, err)
+	_, err = d.GetPartition("truncated")
+	require.Equal(t, rubberhose.ErrNoPartition, err)
+	_, _, err = d.ImportImage("fits", bytes.NewReader(image), int64(len(image)), nil)
+	require.NoError(t, err)
+}
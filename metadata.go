@@ -0,0 +1,99 @@
+package rubberhose
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Metadata describes a partition. It is stored in its own chain of blocks under a key derived from the partition's key,
+// so it is only readable with the password and doesn't take space from the partition's data.
+type Metadata struct {
+	Label      string
+	UUID       string
+	Created    time.Time
+	Filesystem string //The file system the partition is meant to hold, e.g. ext4
+	Notes      string
+}
+
+var ErrNoMetadata = errors.New("partition has no metadata")
+
+// NewMetadata returns metadata with a random UUID and the current time as creation time.
+func NewMetadata(label string) (*Metadata, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40 //Version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 //RFC 4122 variant
+	return &Metadata{
+		Label:   label,
+		UUID:    fmt.Sprintf("%x-%x-%x-%x-%x", uuid[:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]),
+		Created: time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
+
+func metadataKey(key []byte) []byte {
+	return deriveKey(key, "metadata")
+}
+
+func (par *Partition) GetMetadata() (*Metadata, error) {
+	if par.metadata == nil {
+		return nil, ErrNoMetadata
+	}
+	length := make([]byte, 4)
+	if _, err := par.metadata.ReadAt(length, 0); err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, binary.LittleEndian.Uint32(length))
+	if int64(len(encoded)) > par.metadata.GetDataSize()-4 {
+		return nil, ErrInvalidBlockStructure
+	}
+	if _, err := par.metadata.ReadAt(encoded, 4); err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(encoded, m); err != nil {
+		return nil, fmt.Errorf("error decoding metadata: %v", err)
+	}
+	return m, nil
+}
+
+// SetMetadata stores m, allocating or freeing blocks for it as needed.
+func (par *Partition) SetMetadata(m *Metadata) error {
+	if par.IsReadOnly() {
+		return ErrReadOnly
+	}
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 4+len(encoded))
+	binary.LittleEndian.PutUint32(data, uint32(len(encoded)))
+	copy(data[4:], encoded)
+	dataSize, err := par.Disk.taggedDataSize()
+	if err != nil {
+		return err
+	}
+	if par.metadata != nil {
+		dataSize = par.metadata.blockSize
+	}
+	blockCount := (int64(len(data)) + dataSize - 1) / dataSize
+	if par.metadata == nil {
+		key := metadataKey(par.keyFor(par.Disk))
+		meta, err := par.Disk.writePartition(key, blockCount, 0)
+		if err != nil {
+			return err
+		}
+		par.metadata = meta
+	} else if err := par.metadata.Resize(int(blockCount)); err != nil {
+		return err
+	}
+	if _, err := par.metadata.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return par.metadata.Sync()
+}
@@ -0,0 +1,49 @@
+package rubberhose_test
+
+import (
+	"strings"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+100, 12)
+	p, err := d.WritePartition("test", 4)
+	require.NoError(t, err)
+	_, err = p.GetMetadata()
+	require.Equal(t, rubberhose.ErrNoMetadata, err)
+	m, err := rubberhose.NewMetadata("backup")
+	require.NoError(t, err)
+	m.Filesystem = "ext4"
+	require.NoError(t, p.SetMetadata(m))
+	require.Equal(t, 4, p.GetBlockCount())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	readMetadata, err := p.GetMetadata()
+	require.NoError(t, err)
+	require.Equal(t, m, readMetadata)
+	other, err := d.WritePartition("other", 1)
+	require.NoError(t, err)
+	_, err = other.GetMetadata()
+	require.Equal(t, rubberhose.ErrNoMetadata, err)
+	require.NoError(t, other.Delete())
+
+	m.Notes = strings.Repeat("Notes that need more blocks. ", 10)
+	require.NoError(t, p.SetMetadata(m))
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	readMetadata, err = p.GetMetadata()
+	require.NoError(t, err)
+	require.Equal(t, m, readMetadata)
+
+	require.NoError(t, p.Delete())
+	_, err = d.WritePartition("all", 12)
+	require.NoError(t, err)
+}
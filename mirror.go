@@ -0,0 +1,143 @@
+package rubberhose
+
+import "errors"
+
+// ErrMirrorDegraded is returned together with the surviving partition if only one side of a mirror could be opened.
+var ErrMirrorDegraded = errors.New("mirror degraded")
+
+// WriteMirroredPartition creates a partition with the same password and block count on both disks
+// and keeps them in sync from then on.
+func (d *Disk) WriteMirroredPartition(mirror *Disk, password string, blockCount int64) (*Partition, error) {
+	if d.readOnly || mirror.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := checkMirrorDisks(d, mirror); err != nil {
+		return nil, err
+	}
+	par, err := d.WritePartition(password, blockCount)
+	if err != nil {
+		return nil, err
+	}
+	mirrorPar, err := mirror.WritePartition(password, blockCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := par.copyTo(mirrorPar, 0); err != nil {
+		return nil, err
+	}
+	return par, par.setMirror(mirrorPar)
+}
+
+// GetMirroredPartition opens the partition on both disks.
+// If one side is missing or broken the other one is returned together with ErrMirrorDegraded.
+func (d *Disk) GetMirroredPartition(mirror *Disk, password string) (*Partition, error) {
+	if err := checkMirrorDisks(d, mirror); err != nil {
+		return nil, err
+	}
+	par, parErr := d.GetPartition(password)
+	mirrorPar, mirrorErr := mirror.GetPartition(password)
+	switch {
+	case parErr == nil && mirrorErr == nil:
+		if par.getMirror() == mirrorPar {
+			return par, nil
+		}
+		return par, par.setMirror(mirrorPar)
+	case parErr == nil:
+		return par, ErrMirrorDegraded
+	case mirrorErr == nil:
+		return mirrorPar, ErrMirrorDegraded
+	}
+	return nil, parErr
+}
+
+// ResyncMirror restores a mirror after one of its disks has been replaced.
+// The partition is recreated on whichever disk lacks it and filled from the other one, the remains of a broken chain
+// on that disk are wiped first so they aren't mistaken for the partition later.
+// Blocks that fail validation on one side are moved to new blocks and restored from the other side.
+func (d *Disk) ResyncMirror(mirror *Disk, password string) (*Partition, error) {
+	if d.readOnly || mirror.readOnly {
+		return nil, ErrReadOnly
+	}
+	par, err := d.GetMirroredPartition(mirror, password)
+	if err != nil && err != ErrMirrorDegraded {
+		return nil, err
+	}
+	if par.getMirror() == nil {
+		missing := mirror
+		if par.Disk == mirror {
+			missing = d
+		}
+		if err := missing.wipeBlocks(password); err != nil {
+			return nil, err
+		}
+		mirrorPar, err := missing.WritePartition(password, int64(len(par.blocks)))
+		if err != nil {
+			return nil, err
+		}
+		if err := par.copyTo(mirrorPar, 0); err != nil {
+			return nil, err
+		}
+		if err := par.setMirror(mirrorPar); err != nil {
+			return nil, err
+		}
+	} else if err := par.repairBlocks(); err != nil {
+		return nil, err
+	}
+	return par, par.Sync()
+}
+
+func (par *Partition) getMirror() *Partition {
+	for _, r := range par.replicas {
+		if r.Disk != par.Disk {
+			return r
+		}
+	}
+	return nil
+}
+
+func (par *Partition) setMirror(mirror *Partition) error {
+	if len(par.blocks) != len(mirror.blocks) || par.blockSize != mirror.blockSize {
+		return errors.New("mirror partitions differ in size")
+	}
+	par.replicas = append(par.replicas, mirror)
+	return nil
+}
+
+func checkMirrorDisks(d, mirror *Disk) error {
+	if d == mirror {
+		return errors.New("a disk can't mirror itself")
+	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	mirrorBlockSize, err := mirror.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	if blockSize != mirrorBlockSize {
+		return errors.New("mirror disks need the same block size")
+	}
+	return nil
+}
+
+// wipeBlocks wipes all blocks that are valid under the key of the password, including pending ones, and frees them.
+func (d *Disk) wipeBlocks(password string) error {
+	key, err := d.getKey(password)
+	if err != nil {
+		return err
+	}
+	found, err := d.scanBlocks(key, pendingKey(key))
+	if err != nil {
+		return err
+	}
+	for _, blocks := range found {
+		for _, b := range blocks {
+			if err := b.Delete(); err != nil {
+				return err
+			}
+			delete(d.usedBlocks, b.num)
+		}
+	}
+	return d.Sync()
+}
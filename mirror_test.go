@@ -0,0 +1,79 @@
+package rubberhose_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	primary, primaryPath := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	mirror, mirrorPath := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	testPass := "test"
+	p, err := primary.WriteMirroredPartition(mirror, testPass, 4)
+	require.NoError(t, err)
+	testBytes := []byte("This spans multiple blocks")
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, p.Close())
+
+	primary, err = rubberhose.NewDisk(primaryPath)
+	require.NoError(t, err)
+	mirror, err = rubberhose.NewDisk(mirrorPath)
+	require.NoError(t, err)
+	p, err = primary.GetMirroredPartition(mirror, testPass)
+	require.NoError(t, err)
+	size, err := primary.Size()
+	require.NoError(t, err)
+	garbage := make([]byte, size-rubberhose.MinBlockSize)
+	_, err = rand.Read(garbage)
+	require.NoError(t, err)
+	_, err = primary.WriteAt(garbage, rubberhose.MinBlockSize)
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+
+	replacement, replacementPath := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	mirror, err = rubberhose.NewDisk(mirrorPath)
+	require.NoError(t, err)
+	_, err = replacement.GetMirroredPartition(mirror, testPass)
+	require.Equal(t, rubberhose.ErrMirrorDegraded, err)
+	_, err = replacement.ResyncMirror(mirror, testPass)
+	require.NoError(t, err)
+
+	replacement, err = rubberhose.NewDisk(replacementPath)
+	require.NoError(t, err)
+	p, err = replacement.GetPartition(testPass)
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+}
+
+func TestResyncBrokenMirror(t *testing.T) {
+	primary, primaryPath := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	mirror, mirrorPath := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	testPass := "test"
+	p, err := primary.WriteMirroredPartition(mirror, testPass, 4)
+	require.NoError(t, err)
+	testBytes := []byte("The rest of the chain is wiped")
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, rubberhose.DamageBlock(p, 1, 1)) //The mirror's chain breaks, three of its blocks remain
+	require.NoError(t, p.Close())
+
+	primary, err = rubberhose.NewDisk(primaryPath)
+	require.NoError(t, err)
+	mirror, err = rubberhose.NewDisk(mirrorPath)
+	require.NoError(t, err)
+	_, err = primary.ResyncMirror(mirror, testPass)
+	require.NoError(t, err)
+
+	primary, err = rubberhose.NewDisk(primaryPath)
+	require.NoError(t, err)
+	mirror, err = rubberhose.NewDisk(mirrorPath)
+	require.NoError(t, err)
+	p, err = primary.GetMirroredPartition(mirror, testPass)
+	require.NoError(t, err)
+	onMirror, err := mirror.GetPartition(testPass)
+	require.NoError(t, err)
+	require.Equal(t, 4, onMirror.GetBlockCount())
+	requireData(t, onMirror, testBytes, 0)
+}
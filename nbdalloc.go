@@ -0,0 +1,98 @@
+package rubberhose
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrNoFreeDevice = errors.New("no free nbd device")
+
+// DeviceAllocator hands out nbd devices that are neither connected nor allocated by it already.
+// Devices are found in sys/block below Root and their paths are in dev below Root.
+type DeviceAllocator struct {
+	Root      string
+	mu        sync.Mutex
+	allocated map[string]struct{}
+}
+
+var DefaultDeviceAllocator = NewDeviceAllocator("/")
+
+func NewDeviceAllocator(root string) *DeviceAllocator {
+	return &DeviceAllocator{Root: root, allocated: map[string]struct{}{}}
+}
+
+// Allocate returns the path of the free device with the lowest number.
+// The device stays allocated until it is released.
+func (a *DeviceAllocator) Allocate() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	devices, err := a.devices()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range devices {
+		path := filepath.Join(a.Root, "dev", name)
+		if _, ok := a.allocated[path]; ok {
+			continue
+		}
+		inUse, err := a.inUse(name)
+		if err != nil {
+			return "", err
+		}
+		if !inUse {
+			a.allocated[path] = struct{}{}
+			return path, nil
+		}
+	}
+	return "", ErrNoFreeDevice
+}
+
+func (a *DeviceAllocator) Release(path string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.allocated, path)
+}
+
+// devices returns the names of all nbd devices ordered by their number.
+func (a *DeviceAllocator) devices() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(a.Root, "sys", "block"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "nbd") {
+			continue
+		}
+		if num, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "nbd")); err == nil {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	names := make([]string, len(nums))
+	for i, num := range nums {
+		names[i] = "nbd" + strconv.Itoa(num)
+	}
+	return names, nil
+}
+
+// inUse reports whether the device is connected, the pid file only exists while a client serves it.
+func (a *DeviceAllocator) inUse(name string) (bool, error) {
+	_, err := os.Stat(a.pidPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (a *DeviceAllocator) pidPath(name string) string {
+	return filepath.Join(a.Root, "sys", "block", name, "pid")
+}
@@ -0,0 +1,55 @@
+package rubberhose_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceAllocator(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"nbd0", "nbd1", "nbd10", "nbd2", "loop0"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "sys", "block", name), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sys", "block", "nbd0", "pid"), []byte("42\n"), 0644))
+	device := func(name string) string { return filepath.Join(root, "dev", name) }
+
+	a := rubberhose.NewDeviceAllocator(root)
+	path, err := a.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, device("nbd1"), path)
+	path, err = a.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, device("nbd2"), path)
+	path, err = a.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, device("nbd10"), path)
+	_, err = a.Allocate()
+	require.ErrorIs(t, err, rubberhose.ErrNoFreeDevice)
+
+	a.Release(device("nbd2"))
+	path, err = a.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, device("nbd2"), path)
+
+	require.NoError(t, os.Remove(filepath.Join(root, "sys", "block", "nbd0", "pid")))
+	path, err = a.Allocate()
+	require.NoError(t, err)
+	require.Equal(t, device("nbd0"), path)
+
+	_, err = rubberhose.NewDeviceAllocator(t.TempDir()).Allocate()
+	require.ErrorIs(t, err, rubberhose.ErrNoFreeDevice)
+}
+
+func TestKernelExporterError(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sys", "block", "nbd0"), 0755))
+	d, _ := createTestDisk(t, rubberhose.MinBlockSize+10, 4)
+	p, err := d.WritePartition("test", 2)
+	require.NoError(t, err)
+	_, err = p.ExportWith(&rubberhose.KernelExporter{Allocator: rubberhose.NewDeviceAllocator(root)})
+	require.ErrorIs(t, err, os.ErrNotExist) //There is no device file to open
+}
@@ -0,0 +1,352 @@
+package rubberhose
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Constants of the NBD protocol, see https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic            = 0x4e42444d41474943 //"NBDMAGIC"
+	nbdOptMagic         = 0x49484156454f5054 //"IHAVEOPT"
+	nbdOptReplyMagic    = 0x3e889045565a9
+	nbdRequestMagic     = 0x25609513
+	nbdSimpleReplyMagic = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdFlagHasFlags  = 1 << 0
+	nbdFlagReadOnly  = 1 << 1
+	nbdFlagSendFlush = 1 << 2
+	nbdFlagSendFUA   = 1 << 3
+	nbdFlagSendTrim  = 1 << 5
+
+	nbdOptExportName = 1
+	nbdOptAbort      = 2
+	nbdOptList       = 3
+	nbdOptInfo       = 6
+	nbdOptGo         = 7
+
+	nbdRepAck         = 1
+	nbdRepServer      = 2
+	nbdRepInfo        = 3
+	nbdRepErrUnsup    = 1<<31 + 1
+	nbdRepErrInvalid  = 1<<31 + 3
+	nbdRepErrUnknown  = 1<<31 + 6
+	nbdInfoExport     = 0
+	nbdCmdRead        = 0
+	nbdCmdWrite       = 1
+	nbdCmdDisc        = 2
+	nbdCmdFlush       = 3
+	nbdCmdTrim        = 4
+	nbdCmdFlagFUA     = 1 << 0
+	nbdMaxRequestSize = 32 << 20
+	nbdMaxOptionSize  = 4096
+
+	nbdEPERM  = 1
+	nbdEIO    = 5
+	nbdEINVAL = 22
+	nbdENOSPC = 28
+)
+
+// NBDServer serves partitions to NBD clients like qemu or nbd-client using the fixed newstyle handshake.
+// Unlike Expose it doesn't need the nbd kernel module, so partitions can be used by virtual machines or other hosts.
+type NBDServer struct {
+	mu      sync.Mutex
+	exports map[string]*Partition
+}
+
+func NewNBDServer() *NBDServer {
+	return &NBDServer{exports: map[string]*Partition{}}
+}
+
+// AddExport makes the partition available under name.
+// Clients requesting the empty name get the only export if there is exactly one.
+func (s *NBDServer) AddExport(name string, par *Partition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exports[name] = par
+}
+
+func (s *NBDServer) RemoveExport(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.exports, name)
+}
+
+func (s *NBDServer) getExport(name string) *Partition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if par, ok := s.exports[name]; ok {
+		return par
+	}
+	if name == "" && len(s.exports) == 1 {
+		for _, par := range s.exports {
+			return par
+		}
+	}
+	return nil
+}
+
+func (s *NBDServer) exportNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.exports))
+	for name := range s.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serve accepts connections on ln until it is closed, e.g. a listener created with net.Listen("tcp", ":10809").
+func (s *NBDServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// Listen listens on address, a host:port pair or the path of a unix socket, and serves clients in the background.
+func (s *NBDServer) Listen(address string) (net.Listener, error) {
+	network := "tcp"
+	if strings.Contains(address, "/") {
+		network = "unix"
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	go s.Serve(ln)
+	return ln, nil
+}
+
+// ServeConn handles a single client connection until the client disconnects.
+func (s *NBDServer) ServeConn(conn io.ReadWriter) error {
+	par, noZeroes, err := s.handshake(conn)
+	if err != nil || par == nil {
+		return err
+	}
+	if !noZeroes {
+		if _, err := conn.Write(make([]byte, 124)); err != nil {
+			return err
+		}
+	}
+	return serveTransmission(conn, par)
+}
+
+func nbdTransmissionFlags(par *Partition) uint16 {
+	flags := uint16(nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA | nbdFlagSendTrim)
+	if par.IsReadOnly() {
+		flags |= nbdFlagReadOnly
+	}
+	return flags
+}
+
+// handshake negotiates the export. A nil partition without an error means the client aborted.
+func (s *NBDServer) handshake(conn io.ReadWriter) (*Partition, bool, error) {
+	hello := make([]byte, 18)
+	binary.BigEndian.PutUint64(hello, nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:], nbdOptMagic)
+	binary.BigEndian.PutUint16(hello[16:], nbdFlagFixedNewstyle|nbdFlagNoZeroes)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, false, err
+	}
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return nil, false, err
+	}
+	noZeroes := clientFlags&nbdFlagNoZeroes != 0
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			return nil, false, err
+		}
+		if header.Magic != nbdOptMagic {
+			return nil, false, errors.New("invalid nbd option magic")
+		}
+		if header.Length > nbdMaxOptionSize {
+			return nil, false, fmt.Errorf("nbd option of %d bytes too long", header.Length)
+		}
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, false, err
+		}
+		switch header.Option {
+		case nbdOptExportName:
+			par := s.getExport(string(data))
+			if par == nil {
+				return nil, false, fmt.Errorf("unknown export %q", data)
+			}
+			reply := make([]byte, 10)
+			binary.BigEndian.PutUint64(reply, uint64(par.GetDataSize()))
+			binary.BigEndian.PutUint16(reply[8:], nbdTransmissionFlags(par))
+			_, err := conn.Write(reply)
+			return par, noZeroes, err
+		case nbdOptAbort:
+			return nil, false, writeOptionReply(conn, header.Option, nbdRepAck, nil)
+		case nbdOptList:
+			for _, name := range s.exportNames() {
+				reply := make([]byte, 4+len(name))
+				binary.BigEndian.PutUint32(reply, uint32(len(name)))
+				copy(reply[4:], name)
+				if err := writeOptionReply(conn, header.Option, nbdRepServer, reply); err != nil {
+					return nil, false, err
+				}
+			}
+			if err := writeOptionReply(conn, header.Option, nbdRepAck, nil); err != nil {
+				return nil, false, err
+			}
+		case nbdOptInfo, nbdOptGo:
+			if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-6 {
+				if err := writeOptionReply(conn, header.Option, nbdRepErrInvalid, nil); err != nil {
+					return nil, false, err
+				}
+				continue
+			}
+			name := string(data[4 : 4+binary.BigEndian.Uint32(data)])
+			par := s.getExport(name)
+			if par == nil {
+				if err := writeOptionReply(conn, header.Option, nbdRepErrUnknown, nil); err != nil {
+					return nil, false, err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info, nbdInfoExport)
+			binary.BigEndian.PutUint64(info[2:], uint64(par.GetDataSize()))
+			binary.BigEndian.PutUint16(info[10:], nbdTransmissionFlags(par))
+			if err := writeOptionReply(conn, header.Option, nbdRepInfo, info); err != nil {
+				return nil, false, err
+			}
+			if err := writeOptionReply(conn, header.Option, nbdRepAck, nil); err != nil {
+				return nil, false, err
+			}
+			if header.Option == nbdOptGo {
+				return par, true, nil
+			}
+		default:
+			if err := writeOptionReply(conn, header.Option, nbdRepErrUnsup, nil); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+}
+
+func writeOptionReply(w io.Writer, option, replyType uint32, data []byte) error {
+	reply := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint64(reply, nbdOptReplyMagic)
+	binary.BigEndian.PutUint32(reply[8:], option)
+	binary.BigEndian.PutUint32(reply[12:], replyType)
+	binary.BigEndian.PutUint32(reply[16:], uint32(len(data)))
+	copy(reply[20:], data)
+	_, err := w.Write(reply)
+	return err
+}
+
+func serveTransmission(conn io.ReadWriter, par *Partition) error {
+	var request struct {
+		Magic  uint32
+		Flags  uint16
+		Type   uint16
+		Handle uint64
+		Offset uint64
+		Length uint32
+	}
+	for {
+		if err := binary.Read(conn, binary.BigEndian, &request); err != nil {
+			return err
+		}
+		if request.Magic != nbdRequestMagic {
+			return errors.New("invalid nbd request magic")
+		}
+		off, length := int64(request.Offset), int64(request.Length)
+		tooLong := length > nbdMaxRequestSize //Answered with an error, the connection stays usable
+		inRange := off >= 0 && off+length <= par.GetDataSize()
+		var errno uint32
+		var data []byte
+		switch request.Type {
+		case nbdCmdRead:
+			if tooLong || !inRange {
+				errno = nbdEINVAL
+				break
+			}
+			data = make([]byte, length)
+			if _, err := par.ReadAt(data, off); err != nil {
+				errno = nbdEIO
+			}
+		case nbdCmdWrite:
+			if tooLong {
+				if _, err := io.CopyN(io.Discard, conn, length); err != nil {
+					return err
+				}
+				errno = nbdEINVAL
+				break
+			}
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return err
+			}
+			write := par.WriteAt
+			if request.Flags&nbdCmdFlagFUA != 0 {
+				write = par.WriteAtFUA
+			}
+			if !inRange {
+				errno = nbdENOSPC
+			} else if _, err := write(buf, off); err != nil {
+				errno = nbdErrno(err)
+			}
+		case nbdCmdDisc:
+			return par.Sync()
+		case nbdCmdFlush:
+			if err := par.Sync(); err != nil {
+				errno = nbdErrno(err)
+			}
+		case nbdCmdTrim:
+			if !inRange {
+				errno = nbdEINVAL
+			} else if err := par.Trim(off, length); err != nil {
+				errno = nbdErrno(err)
+			}
+		default:
+			errno = nbdEINVAL
+		}
+		reply := make([]byte, 16, 16+len(data))
+		binary.BigEndian.PutUint32(reply, nbdSimpleReplyMagic)
+		binary.BigEndian.PutUint32(reply[4:], errno)
+		binary.BigEndian.PutUint64(reply[8:], request.Handle)
+		if errno == 0 {
+			reply = append(reply, data...)
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+func nbdErrno(err error) uint32 {
+	if err == ErrReadOnly {
+		return nbdEPERM
+	}
+	return nbdEIO
+}
@@ -0,0 +1,202 @@
+package rubberhose_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+// nbdClient is a minimal NBD client speaking the fixed newstyle protocol.
+type nbdClient struct {
+	t      *testing.T
+	conn   net.Conn
+	handle uint64
+	size   uint64
+	flags  uint16
+}
+
+func dialNBD(t *testing.T, network, address string) *nbdClient {
+	conn, err := net.Dial(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	var hello struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}
+	require.NoError(t, binary.Read(conn, binary.BigEndian, &hello))
+	require.Equal(t, uint64(0x4e42444d41474943), hello.Magic)
+	require.Equal(t, uint64(0x49484156454f5054), hello.OptMagic)
+	require.NotZero(t, hello.Flags&1)
+	require.NoError(t, binary.Write(conn, binary.BigEndian, uint32(3))) //Fixed newstyle, no zeroes
+	return &nbdClient{t: t, conn: conn}
+}
+
+func (c *nbdClient) option(option uint32, data []byte) {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header, 0x49484156454f5054)
+	binary.BigEndian.PutUint32(header[8:], option)
+	binary.BigEndian.PutUint32(header[12:], uint32(len(data)))
+	_, err := c.conn.Write(append(header, data...))
+	require.NoError(c.t, err)
+}
+
+func (c *nbdClient) optionReply(option uint32) (uint32, []byte) {
+	var reply struct {
+		Magic  uint64
+		Option uint32
+		Type   uint32
+		Length uint32
+	}
+	require.NoError(c.t, binary.Read(c.conn, binary.BigEndian, &reply))
+	require.Equal(c.t, uint64(0x3e889045565a9), reply.Magic)
+	require.Equal(c.t, option, reply.Option)
+	data := make([]byte, reply.Length)
+	_, err := io.ReadFull(c.conn, data)
+	require.NoError(c.t, err)
+	return reply.Type, data
+}
+
+func (c *nbdClient) list() []string {
+	c.option(3, nil)
+	var names []string
+	for {
+		replyType, data := c.optionReply(3)
+		if replyType == 1 {
+			return names
+		}
+		require.Equal(c.t, uint32(2), replyType)
+		names = append(names, string(data[4:4+binary.BigEndian.Uint32(data)]))
+	}
+}
+
+// open selects the export using NBD_OPT_GO and reports whether the server knows it.
+func (c *nbdClient) open(name string) bool {
+	data := make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(name)))
+	copy(data[4:], name)
+	c.option(7, data)
+	for {
+		replyType, data := c.optionReply(7)
+		switch replyType {
+		case 1:
+			return true
+		case 3:
+			require.Equal(c.t, uint16(0), binary.BigEndian.Uint16(data))
+			c.size = binary.BigEndian.Uint64(data[2:])
+			c.flags = binary.BigEndian.Uint16(data[10:])
+		default:
+			require.NotZero(c.t, replyType&(1<<31))
+			return false
+		}
+	}
+}
+
+func (c *nbdClient) request(cmd, flags uint16, off uint64, length uint32, data []byte) (uint32, []byte) {
+	c.handle++
+	request := make([]byte, 28)
+	binary.BigEndian.PutUint32(request, 0x25609513)
+	binary.BigEndian.PutUint16(request[4:], flags)
+	binary.BigEndian.PutUint16(request[6:], cmd)
+	binary.BigEndian.PutUint64(request[8:], c.handle)
+	binary.BigEndian.PutUint64(request[16:], off)
+	binary.BigEndian.PutUint32(request[24:], length)
+	_, err := c.conn.Write(append(request, data...))
+	require.NoError(c.t, err)
+	if cmd == 2 {
+		return 0, nil
+	}
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	require.NoError(c.t, binary.Read(c.conn, binary.BigEndian, &reply))
+	require.Equal(c.t, uint32(0x67446698), reply.Magic)
+	require.Equal(c.t, c.handle, reply.Handle)
+	if cmd != 0 || reply.Error != 0 {
+		return reply.Error, nil
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(c.conn, buf)
+	require.NoError(c.t, err)
+	return 0, buf
+}
+
+func TestNBDServer(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	p, err := d.WritePartition("test", 4)
+	require.NoError(t, err)
+	server := rubberhose.NewNBDServer()
+	server.AddExport("secret", p)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+	go server.Serve(tcp)
+	unixSocket, err := net.Listen("unix", filepath.Join(t.TempDir(), "nbd.sock"))
+	require.NoError(t, err)
+	defer unixSocket.Close()
+	go server.Serve(unixSocket)
+
+	c := dialNBD(t, "tcp", tcp.Addr().String())
+	require.Equal(t, []string{"secret"}, c.list())
+	require.False(t, c.open("unknown"))
+	require.True(t, c.open("secret"))
+	require.Equal(t, uint64(40), c.size)
+	require.Zero(t, c.flags&2)
+	testBytes := []byte("Served over the network")
+	errno, _ := c.request(1, 0, 5, uint32(len(testBytes)), testBytes)
+	require.Zero(t, errno)
+	errno, _ = c.request(1, 1, 0, 3, []byte("FUA"))
+	require.Zero(t, errno)
+	errno, _ = c.request(3, 0, 0, 0, nil)
+	require.Zero(t, errno)
+	errno, data := c.request(0, 0, 0, 28, nil)
+	require.Zero(t, errno)
+	require.Equal(t, []byte("FUA"), data[:3])
+	require.Equal(t, testBytes, data[5:])
+	errno, _ = c.request(0, 0, 30, 20, nil)
+	require.NotZero(t, errno)
+	errno, _ = c.request(4, 0, 5, 6, nil)
+	require.Zero(t, errno)
+	tooLong := 32<<20 + 1
+	errno, _ = c.request(0, 0, 0, uint32(tooLong), nil)
+	require.Equal(t, uint32(22), errno)
+	errno, _ = c.request(1, 0, 0, uint32(tooLong), make([]byte, tooLong))
+	require.Equal(t, uint32(22), errno)
+	errno, data = c.request(0, 0, 0, 3, nil) //The connection is still usable
+	require.Zero(t, errno)
+	require.Equal(t, []byte("FUA"), data)
+	c.request(2, 0, 0, 0, nil)
+
+	other, err := rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	onDisk, err := other.GetPartition("test")
+	require.NoError(t, err)
+	readBytes := make([]byte, 28)
+	_, err = onDisk.ReadAt(readBytes, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("FUA"), readBytes[:3])
+	require.Equal(t, make([]byte, 6), readBytes[5:11])
+	require.Equal(t, testBytes[6:], readBytes[11:])
+
+	readOnly, err := rubberhose.NewDiskReadOnly(path)
+	require.NoError(t, err)
+	readOnlyPar, err := readOnly.GetPartition("test")
+	require.NoError(t, err)
+	server.RemoveExport("secret")
+	server.AddExport("backup", readOnlyPar)
+	c = dialNBD(t, "unix", unixSocket.Addr().String())
+	require.True(t, c.open(""))
+	require.NotZero(t, c.flags&2)
+	errno, data = c.request(0, 0, 11, uint32(len(testBytes)-6), nil)
+	require.Zero(t, errno)
+	require.Equal(t, testBytes[6:], data)
+	errno, _ = c.request(1, 0, 0, 3, []byte("abc"))
+	require.Equal(t, uint32(1), errno)
+}
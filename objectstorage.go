@@ -0,0 +1,359 @@
+package rubberhose
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore for objects that don't exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// An ObjectStore stores named objects, e.g. in a bucket of an S3-compatible service.
+type ObjectStore interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Delete(name string) error
+}
+
+const (
+	headerObject           = "header"
+	sizeObject             = "size"
+	defaultObjectCacheSize = 64
+)
+
+// ObjectStorage stores a disk in an ObjectStore: one object holds the disk header and one object each block.
+// Blocks are filled with random data when the disk is written, so all block objects look alike and reveal
+// neither plaintext nor which blocks belong to partitions.
+// Objects are fetched on demand and kept in a cache, changes are uploaded by Sync or when a changed object is evicted.
+type ObjectStorage struct {
+	Store     ObjectStore
+	CacheSize int //Maximum number of cached objects, zero means 64
+
+	mu        sync.Mutex
+	size      int64 //-1 until loaded
+	sizeDirty bool
+	blockSize int64 //0 until read from the header
+	cache     map[string]*list.Element
+	lru       *list.List
+}
+
+type cachedObject struct {
+	name  string
+	data  []byte
+	dirty bool
+}
+
+func NewObjectStorage(store ObjectStore) *ObjectStorage {
+	return &ObjectStorage{Store: store, size: -1, cache: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (s *ObjectStorage) loadSize() error {
+	if s.size >= 0 {
+		return nil
+	}
+	data, err := s.Store.Get(sizeObject)
+	if err == ErrObjectNotFound {
+		s.size = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.size, err = strconv.ParseInt(string(data), 10, 64)
+	return err
+}
+
+func (s *ObjectStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadSize(); err != nil {
+		return 0, err
+	}
+	return s.size, nil
+}
+
+// locate returns the object holding the byte at off and the offset of the object on the disk.
+func (s *ObjectStorage) locate(off int64) (string, int64, error) {
+	if off < dataOffset {
+		return headerObject, 0, nil
+	}
+	if s.blockSize == 0 {
+		header, err := s.object(headerObject)
+		if err != nil {
+			return "", 0, err
+		}
+		s.blockSize = int64(binary.LittleEndian.Uint64(header.data[blockSizeOffset:]))
+		if s.blockSize < MinBlockSize {
+			s.blockSize = 0
+			return "", 0, errors.New("the disk header has to be written before its blocks")
+		}
+	}
+	num := (off - dataOffset) / s.blockSize
+	return blockObject(num), dataOffset + num*s.blockSize, nil
+}
+
+func blockObject(num int64) string {
+	return "block-" + strconv.FormatInt(num, 10)
+}
+
+func (s *ObjectStorage) objectSize(name string) int64 {
+	if name == headerObject {
+		return dataOffset
+	}
+	return s.blockSize
+}
+
+// object returns the cached object, fetching it if needed. Objects that don't exist yet are filled with zeros.
+func (s *ObjectStorage) object(name string) (*cachedObject, error) {
+	if e, ok := s.cache[name]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*cachedObject), nil
+	}
+	data, err := s.Store.Get(name)
+	if err != nil && err != ErrObjectNotFound {
+		return nil, err
+	}
+	if size := s.objectSize(name); int64(len(data)) != size {
+		padded := make([]byte, size)
+		copy(padded, data)
+		data = padded
+	}
+	obj := &cachedObject{name: name, data: data}
+	s.cache[name] = s.lru.PushFront(obj)
+	cacheSize := s.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultObjectCacheSize
+	}
+	for s.lru.Len() > cacheSize {
+		oldest := s.lru.Back()
+		evicted := oldest.Value.(*cachedObject)
+		if evicted.dirty {
+			if err := s.Store.Put(evicted.name, evicted.data); err != nil {
+				return nil, err //The object stays cached and dirty, so its data isn't lost
+			}
+			evicted.dirty = false
+		}
+		s.lru.Remove(oldest)
+		delete(s.cache, evicted.name)
+	}
+	return obj, nil
+}
+
+func (s *ObjectStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadSize(); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > s.size {
+		end = s.size
+	}
+	n := 0
+	for pos := off; pos < end; {
+		name, start, err := s.locate(pos)
+		if err != nil {
+			return n, err
+		}
+		obj, err := s.object(name)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:end-off], obj.data[pos-start:])
+		n += copied
+		pos += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *ObjectStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadSize(); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		name, start, err := s.locate(pos)
+		if err != nil {
+			return n, err
+		}
+		obj, err := s.object(name)
+		if err != nil {
+			return n, err
+		}
+		n += copy(obj.data[pos-start:], p[n:])
+		obj.dirty = true
+		if name == headerObject {
+			s.blockSize = 0 //The block size may have changed
+		}
+	}
+	if end := off + int64(n); end > s.size {
+		s.size = end
+		s.sizeDirty = true
+	}
+	return n, nil
+}
+
+// Truncate changes the size of the disk. When shrinking, the new size is stored before the objects
+// beyond it are deleted.
+func (s *ObjectStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadSize(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("negative size %d", size)
+	}
+	if size >= s.size {
+		if size > s.size {
+			s.size, s.sizeDirty = size, true
+		}
+		return nil
+	}
+	old := s.size
+	if err := s.Store.Put(sizeObject, []byte(strconv.FormatInt(size, 10))); err != nil {
+		return err
+	}
+	s.size, s.sizeDirty = size, false
+	if old <= dataOffset {
+		return nil
+	}
+	first, err := s.locateBlock(size)
+	if err != nil {
+		return err
+	}
+	last, err := s.locateBlock(old - 1)
+	if err != nil {
+		return err
+	}
+	for num := first; num <= last; num++ {
+		name, start := blockObject(num), dataOffset+num*s.blockSize
+		if start < size { //Partially cut off, the rest is zeroed like in a file
+			obj, err := s.object(name)
+			if err != nil {
+				return err
+			}
+			for i := size - start; i < int64(len(obj.data)); i++ {
+				obj.data[i] = 0
+			}
+			obj.dirty = true
+			continue
+		}
+		if e, ok := s.cache[name]; ok {
+			s.lru.Remove(e)
+			delete(s.cache, name)
+		}
+		if err := s.Store.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// locateBlock returns the number of the block holding the byte at off, blocks before the first one count as the first.
+func (s *ObjectStorage) locateBlock(off int64) (int64, error) {
+	if off < dataOffset {
+		off = dataOffset
+	}
+	if _, _, err := s.locate(off); err != nil {
+		return 0, err
+	}
+	return (off - dataOffset) / s.blockSize, nil
+}
+
+// Sync uploads all changed objects.
+func (s *ObjectStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		obj := e.Value.(*cachedObject)
+		if !obj.dirty {
+			continue
+		}
+		if err := s.Store.Put(obj.name, obj.data); err != nil {
+			return err
+		}
+		obj.dirty = false
+	}
+	if s.sizeDirty {
+		if err := s.Store.Put(sizeObject, []byte(strconv.FormatInt(s.size, 10))); err != nil {
+			return err
+		}
+		s.sizeDirty = false
+	}
+	return nil
+}
+
+// Close uploads all changed objects and empties the cache.
+func (s *ObjectStorage) Close() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = map[string]*list.Element{}
+	s.lru.Init()
+	return nil
+}
+
+// DirObjectStore keeps objects as files in a directory, e.g. on a mounted network file system or in tests.
+type DirObjectStore string
+
+func (dir DirObjectStore) Get(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(dir), name))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return data, err
+}
+
+// Put replaces the object atomically by writing a temporary file and renaming it.
+func (dir DirObjectStore) Put(name string, data []byte) error {
+	f, err := os.CreateTemp(string(dir), "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(string(dir), name))
+}
+
+func (dir DirObjectStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(string(dir), name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectStorage(t *testing.T) {
+	dir := t.TempDir()
+	store := rubberhose.DirObjectStore(dir)
+	s := rubberhose.NewObjectStorage(store)
+	s.CacheSize = 3 //Smaller than the partition, so changed blocks get evicted
+	d := rubberhose.NewDiskFromStorage(s)
+	require.NoError(t, d.Write(rubberhose.MinBlockSize+100, 10))
+	p, err := d.WritePartition("test", 6)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("remote "), 80)
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, d.Close())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 12) //Header, size and one object per block
+	for _, e := range entries {
+		data, err := os.ReadFile(dir + "/" + e.Name())
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte("remote")))
+	}
+
+	d = rubberhose.NewDiskFromStorage(rubberhose.NewObjectStorage(store))
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), count)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+
+	require.NoError(t, d.Grow(2))
+	require.NoError(t, d.Shrink(7, false))
+	require.NoError(t, d.Close())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 9)
+	d = rubberhose.NewDiskFromStorage(rubberhose.NewObjectStorage(store))
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+}
+
+type failingStore struct {
+	rubberhose.ObjectStore
+	fail bool
+}
+
+func (s *failingStore) Put(name string, data []byte) error {
+	if s.fail {
+		return errors.New("upload failed")
+	}
+	return s.ObjectStore.Put(name, data)
+}
+
+func TestObjectStorageFailedEviction(t *testing.T) {
+	const blockSize = rubberhose.MinBlockSize + 10
+	store := &failingStore{ObjectStore: rubberhose.DirObjectStore(t.TempDir())}
+	s := rubberhose.NewObjectStorage(store)
+	s.CacheSize = 1
+	require.NoError(t, rubberhose.NewDiskFromStorage(s).Write(blockSize, 4))
+	testBytes := []byte("Kept until uploaded")
+	_, err := s.WriteAt(testBytes, 32+blockSize)
+	require.NoError(t, err)
+	store.fail = true
+	_, err = s.ReadAt(make([]byte, 1), 32+2*blockSize) //Evicts the written block
+	require.Error(t, err)
+	store.fail = false
+	require.NoError(t, s.Sync())
+
+	buf := make([]byte, len(testBytes))
+	_, err = rubberhose.NewObjectStorage(store).ReadAt(buf, 32+blockSize)
+	require.NoError(t, err)
+	require.Equal(t, testBytes, buf)
+}
@@ -1,25 +1,27 @@
 package rubberhose
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io"
-	"log"
-
-	"github.com/dop251/buse"
+	"sync"
 )
 
 type Partition struct {
 	*Disk
-	*ExposedPartition
-	blockSize int64
+	blockSize int64 //Data bytes per block, byte off of the partition is at off%blockSize in block off/blockSize
 	key       []byte
 	blocks    []*Block
-}
-
-type ExposedPartition struct {
-	*buse.Device
-	Path string
+	tagged    bool //The blocks are tagged, see taggedBlockMagic
+	pool      *Pool
+	keys      map[*Disk][]byte
+	password  string
+	replicas  []*Partition //Partitions holding identical copies of the data, e.g. on a mirror disk
+	copies    int          //Number of copies of a redundant partition, stored in every block; 0 otherwise
+	cache     *blockCache
+	export    Export
+	metadata  *Partition   //Holds the encoded Metadata, nil if there is none
+	mu        sync.RWMutex //Held for reading during I/O and for writing while blocks are relocated (see Rerandomize)
 }
 
 func NewPartition(blockSize int64, blocks []*Block) Partition {
@@ -27,6 +29,15 @@ func NewPartition(blockSize int64, blocks []*Block) Partition {
 }
 
 func (par *Partition) ReadAt(p []byte, off int64) (int, error) {
+	par.mu.RLock()
+	defer par.mu.RUnlock()
+	if par.cache != nil {
+		return par.cachedReadAt(p, off)
+	}
+	return par.readData(p, off)
+}
+
+func (par *Partition) readData(p []byte, off int64) (int, error) {
 	blockNum := off / par.blockSize
 	blockOff := off % par.blockSize
 	if blockNum > int64(len(par.blocks)) {
@@ -37,18 +48,50 @@ func (par *Partition) ReadAt(p []byte, off int64) (int, error) {
 		if int(blockNum) >= len(par.blocks) {
 			return originalLength - len(p), io.EOF
 		}
-		read, err := par.blocks[blockNum].ReadAt(p, blockOff)
-		if err != io.EOF {
+		read, err := par.readBlock(int(blockNum), p, blockOff)
+		p = p[read:]
+		if err != nil && err != io.EOF {
 			return originalLength - len(p), err
 		}
-		p = p[read:]
 		blockOff = 0
 		blockNum++
 	}
 	return originalLength, nil
 }
 
+func (par *Partition) readBlock(i int, p []byte, off int64) (int, error) {
+	if len(par.replicas) == 0 {
+		return par.blocks[i].ReadAt(p, off)
+	}
+	b, err := par.sourceBlock(i)
+	if err != nil {
+		return 0, err
+	}
+	return b.ReadAt(p, off)
+}
+
 func (par *Partition) WriteAt(p []byte, off int64) (int, error) {
+	if par.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	par.mu.RLock()
+	defer par.mu.RUnlock()
+	return par.write(p, off)
+}
+
+func (par *Partition) write(p []byte, off int64) (int, error) {
+	if par.cache != nil {
+		return par.cachedWriteAt(p, off)
+	}
+	return par.writeData(p, off)
+}
+
+func (par *Partition) writeData(p []byte, off int64) (int, error) {
+	for _, r := range par.replicas {
+		if n, err := r.writeData(p, off); err != nil {
+			return n, err
+		}
+	}
 	blockNum := off / par.blockSize
 	blockOff := off % par.blockSize
 	if blockNum > int64(len(par.blocks)) {
@@ -59,7 +102,7 @@ func (par *Partition) WriteAt(p []byte, off int64) (int, error) {
 		if int(blockNum) >= len(par.blocks) {
 			return originalLength - len(p), io.EOF
 		}
-		written, err := par.blocks[blockNum].WriteAt(p, blockOff)
+		written, err := par.writeBlock(int(blockNum), p, blockOff)
 		p = p[written:]
 		if err != nil && err != io.ErrShortWrite {
 			return originalLength - len(p), err
@@ -70,6 +113,36 @@ func (par *Partition) WriteAt(p []byte, off int64) (int, error) {
 	return originalLength, nil
 }
 
+// writeBlock writes to the i-th block, blocks missing in a copy of a redundant partition are skipped.
+func (par *Partition) writeBlock(i int, p []byte, off int64) (int, error) {
+	if par.blocks[i] != nil {
+		return par.blocks[i].WriteAt(p, off)
+	}
+	if int64(len(p)) > par.blockSize-off {
+		return int(par.blockSize - off), io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+// IsReadOnly reports whether any disk holding the partition or one of its copies was opened read-only.
+func (par *Partition) IsReadOnly() bool {
+	if par.pool != nil {
+		for _, d := range par.pool.Disks {
+			if d.readOnly {
+				return true
+			}
+		}
+	} else if par.Disk != nil && par.Disk.readOnly {
+		return true
+	}
+	for _, r := range par.replicas {
+		if r.IsReadOnly() {
+			return true
+		}
+	}
+	return false
+}
+
 func (par *Partition) GetBlockCount() int {
 	return len(par.blocks)
 }
@@ -77,6 +150,10 @@ func (par *Partition) GetBlockCount() int {
 func (par *Partition) GetDataSize() int64 {
 	var size int64
 	for _, b := range par.blocks {
+		if b == nil {
+			size += par.blockSize
+			continue
+		}
 		size += b.GetDataSize()
 	}
 	return size
@@ -90,11 +167,11 @@ func (par *Partition) orderBlocks() error {
 	for len(blocks) != 0 {
 		blockToRemove := -1
 		for i, b := range blocks {
-			nextBlockNum, err := b.GetNextBlockID()
-			if err != nil {
-				return err
-			}
 			if len(finished) == 0 {
+				nextBlockNum, err := b.GetNextBlockID()
+				if err != nil {
+					return err
+				}
 				if nextBlockNum != -1 {
 					continue
 				}
@@ -102,8 +179,11 @@ func (par *Partition) orderBlocks() error {
 				blockToRemove = i
 				break
 			}
-			lastBlockNum := finished[len(finished)-1].num
-			if nextBlockNum == lastBlockNum {
+			pointsToLast, err := b.pointsTo(finished[len(finished)-1])
+			if err != nil {
+				return err
+			}
+			if pointsToLast {
 				finished = append(finished, b)
 				blockToRemove = i
 				break
@@ -119,83 +199,250 @@ func (par *Partition) orderBlocks() error {
 		finished[i], finished[j] = finished[j], finished[i]
 	}
 	copy(par.blocks, finished)
+	for i, b := range par.blocks {
+		b.index = int64(i)
+	}
 	return nil
 }
 
-func (par *Partition) Close() error {
-	return par.Sync()
+// Sync writes all buffered data to the disks and flushes them. Once it returns the data survives a crash.
+// It is called for NBD flush requests.
+func (par *Partition) Sync() error {
+	par.mu.RLock()
+	defer par.mu.RUnlock()
+	if err := par.flushCache(); err != nil {
+		return err
+	}
+	return par.syncDisks()
 }
 
-var counter int
+func (par *Partition) syncDisks() error {
+	for _, r := range par.replicas {
+		if err := r.syncDisks(); err != nil {
+			return err
+		}
+	}
+	return syncBlocks(par.blocks)
+}
 
-func (par *Partition) Expose() (string, *buse.Device) {
-	for {
-		path := fmt.Sprintf("/dev/nbd%d", counter)
-		counter++
-		bd, err := par.ExposePath(path)
-		if err != nil {
-			continue
+// WriteAtFUA works like WriteAt but only returns once the written data survives a crash (force unit access).
+// Other buffered writes aren't flushed.
+func (par *Partition) WriteAtFUA(p []byte, off int64) (int, error) {
+	if par.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	par.mu.RLock()
+	defer par.mu.RUnlock()
+	n, err := par.write(p, off)
+	if err != nil {
+		return n, err
+	}
+	if err := par.flushRange(off, int64(n)); err != nil {
+		return 0, err
+	}
+	return n, par.syncDisks()
+}
+
+// Trim zeroes the given range of data. It is called for NBD trim requests.
+func (par *Partition) Trim(off, length int64) error {
+	if par.IsReadOnly() {
+		return ErrReadOnly
+	}
+	par.mu.RLock()
+	defer par.mu.RUnlock()
+	zeros := make([]byte, par.blockSize)
+	for length > 0 {
+		n := length
+		if n > par.blockSize {
+			n = par.blockSize
+		}
+		if _, err := par.write(zeros[:n], off); err != nil {
+			return err
 		}
-		return path, bd
+		off += n
+		length -= n
 	}
+	return nil
 }
 
-func (par *Partition) ExposePath(path string) (*buse.Device, error) {
-	if ep := par.ExposedPartition; ep != nil {
-		ep.Device.Disconnect()
-		par.ExposedPartition = nil
+// Close stops exporting the partition and writes all buffered data to the disks.
+func (par *Partition) Close() error {
+	if err := par.Unexport(); err != nil {
+		return err
+	}
+	return par.Sync()
+}
+
+func (par *Partition) keyFor(d *Disk) []byte {
+	if par.pool != nil {
+		return par.keys[d]
+	}
+	return par.key
+}
+
+func (par *Partition) allocateBlock() (*Block, error) {
+	var b *Block
+	var err error
+	if par.pool != nil {
+		b, err = par.pool.allocateBlock(par.keys)
+	} else {
+		b, err = par.Disk.allocateBlock(par.key)
 	}
-	bd, err := buse.NewDevice(path, par.GetDataSize(), par)
 	if err != nil {
 		return nil, err
 	}
-	go func() {
-		err := bd.Run()
-		if err != nil {
-			log.Fatal("Error running buse device: ", err)
-		}
-	}()
-	par.ExposedPartition = &ExposedPartition{Path: path, Device: bd}
-	return bd, nil
+	b.tagged, b.copies = par.tagged, par.copies
+	return b, nil
 }
 
-func (par Partition) Delete() error {
-	for _, b := range par.blocks {
-		err := b.Delete()
-		if err != nil {
+func (par *Partition) linkBlocks(from, to *Block) error {
+	ref, err := from.refTo(to)
+	if err != nil {
+		return err
+	}
+	return from.Write(ref)
+}
+
+// writeBlockHeader (re)writes the header of the i-th block so that it points to its successor.
+// If the successor is missing, the header is left alone until the successor is filled (see replaceBlock).
+func (par *Partition) writeBlockHeader(i int) error {
+	if i == len(par.blocks)-1 {
+		return par.blocks[i].Write(-1)
+	}
+	if par.blocks[i+1] == nil {
+		return nil
+	}
+	return par.linkBlocks(par.blocks[i], par.blocks[i+1])
+}
+
+func (par *Partition) Delete() error {
+	return par.DeleteContext(context.Background(), nil)
+}
+
+// DeleteContext works like Delete and reports the progress in bytes.
+// The metadata and the replicas are deleted first, so ctx can only stop the deletion until the first of them
+// is removed, after that all blocks are wiped so that no data is left behind.
+func (par *Partition) DeleteContext(ctx context.Context, progress Progress) error {
+	if par.IsReadOnly() {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := par.checkCopies(); err != nil {
+		return err
+	}
+	if err := par.Unexport(); err != nil {
+		return err
+	}
+	chains := par.deletionOrder()
+	var total int64
+	for _, chain := range chains {
+		total += 2 * int64(len(chain.blocks))
+	}
+	s := newSteps(progress, total, par.blockSize)
+	for _, chain := range chains {
+		chain.dropCache(0)
+		if err := chain.truncateBlocksContext(ctx, 0, s); err != nil {
 			return err
 		}
-		delete(par.Disk.usedBlocks, b.num)
+		ctx = context.Background()
 	}
-	return par.Sync()
+	return nil
+}
+
+// deletionOrder returns the chains of the partition in the order they are deleted, the partition itself comes last.
+func (par *Partition) deletionOrder() []*Partition {
+	var chains []*Partition
+	if par.metadata != nil {
+		chains = append(chains, par.metadata)
+	}
+	for _, r := range par.replicas {
+		chains = append(chains, r.deletionOrder()...)
+	}
+	return append(chains, par)
 }
 
 func (par *Partition) Resize(blockCount int) error {
-	delta := blockCount - len(par.blocks)
-	if delta == 0 {
-		return nil
+	return par.ResizeContext(context.Background(), blockCount, nil)
+}
+
+// ResizeContext works like Resize and reports the progress in bytes.
+// If ctx is done before the partition itself changed, the replicas are resized back and ctx.Err() is returned.
+func (par *Partition) ResizeContext(ctx context.Context, blockCount int, progress Progress) error {
+	if par.IsReadOnly() {
+		return ErrReadOnly
 	}
-	if delta > 0 {
-		lastBlock := par.blocks[len(par.blocks)-1]
-		for i := 0; i < delta; i++ {
-			block, err := par.Disk.allocateBlock(par.key)
-			if err != nil {
-				return err
-			}
-			if err := lastBlock.Write(block.num); err != nil {
-				return err
-			}
-			par.blocks = append(par.blocks, block)
+	par.mu.Lock() //Readers and writers must not see the block list while it changes
+	defer par.mu.Unlock()
+	if err := par.checkCopies(); err != nil {
+		return err
+	}
+	if err := par.flushCache(); err != nil {
+		return err
+	}
+	oldCount := len(par.blocks)
+	delta := int64(blockCount - oldCount)
+	if delta < 0 {
+		delta = -delta
+	}
+	s := newSteps(progress, 2*delta*int64(1+len(par.replicas)), par.blockSize)
+	for _, r := range par.replicas {
+		if err := r.flushCache(); err != nil {
+			return err
 		}
-	} else {
-		off := len(par.blocks) + delta
-		toDelete := par.blocks[off:]
-		par.blocks = par.blocks[:off]
-		for _, b := range toDelete {
-			if err := b.Delete(); err != nil {
-				return err
-			}
+		if err := r.resizeContext(context.Background(), blockCount, s); err != nil {
+			return err
+		}
+	}
+	if err := par.resizeContext(ctx, blockCount, s); err != nil {
+		if err == ctx.Err() {
+			return par.undoReplicaResize(blockCount, err)
+		}
+		return err
+	}
+	for _, r := range par.replicas {
+		if err := par.copyTo(r, oldCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undoReplicaResize brings the replicas back to the size of the partition after resizing it to blockCount
+// was cancelled with err.
+func (par *Partition) undoReplicaResize(blockCount int, err error) error {
+	for _, r := range par.replicas {
+		if err := r.resize(len(par.blocks)); err != nil {
+			return err
+		}
+		if err := par.copyTo(r, blockCount); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (par *Partition) resize(blockCount int) error {
+	return par.resizeContext(context.Background(), blockCount, nil)
+}
+
+func (par *Partition) resizeContext(ctx context.Context, blockCount int, s *steps) error {
+	if blockCount < 1 {
+		return errors.New("a partition needs at least one block")
+	}
+	delta := blockCount - len(par.blocks)
+	if delta < 0 {
+		par.dropCache(blockCount)
+		return par.truncateBlocksContext(ctx, blockCount, s)
+	}
+	blocks := make([]*Block, 0, delta)
+	for i := 0; i < delta; i++ {
+		block, err := par.allocateBlock()
+		if err != nil {
+			return err
 		}
+		blocks = append(blocks, block)
 	}
-	return par.blocks[len(par.blocks)-1].Write(-1)
+	return par.appendBlocksContext(ctx, blocks, s)
 }
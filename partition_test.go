@@ -2,7 +2,6 @@ package rubberhose_test
 
 import (
 	"crypto/rand"
-	"os"
 	"testing"
 
 	rubberhose "github.com/Cookie04DE/RubberHose"
@@ -10,12 +9,10 @@ import (
 )
 
 func TestPartition(t *testing.T) {
-	f, err := os.CreateTemp("", "")
-	require.NoError(t, err)
 	key := make([]byte, 16)
-	_, err = rand.Read(key)
+	_, err := rand.Read(key)
 	require.NoError(t, err)
-	d := rubberhose.NewDiskFromFile(f)
+	d := rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(0))
 	b1, err := rubberhose.NewBlock(d, key, 0, 0, rubberhose.MinBlockSize+1)
 	require.NoError(t, err)
 	err = b1.Write(1)
@@ -24,14 +21,59 @@ func TestPartition(t *testing.T) {
 	require.NoError(t, err)
 	err = b2.Write(-1)
 	require.NoError(t, err)
-	partition := rubberhose.NewPartition(1, []*rubberhose.Block{b1, b2})
-	_, err = partition.WriteAt([]byte("ab"), 0)
+	dataSize := b1.GetDataSize()
+	partition := rubberhose.NewPartition(dataSize, []*rubberhose.Block{b1, b2})
+	_, err = partition.WriteAt([]byte("ab"), dataSize-1)
 	require.NoError(t, err)
 	buf := make([]byte, 1)
-	_, err = partition.ReadAt(buf, 0)
+	_, err = partition.ReadAt(buf, dataSize-1)
 	require.NoError(t, err)
 	require.Equal(t, "a", string(buf))
-	_, err = partition.ReadAt(buf, 1)
+	_, err = partition.ReadAt(buf, dataSize)
 	require.NoError(t, err)
 	require.Equal(t, "b", string(buf))
 }
+
+func TestPartitionLayout(t *testing.T) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	d := rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(0))
+	var blocks []*rubberhose.Block
+	for i := int64(0); i < 3; i++ {
+		b, err := rubberhose.NewBlock(d, key, 0, i, 42) //10 bytes of data after the 32 byte header
+		require.NoError(t, err)
+		require.NoError(t, b.Write(i+1))
+		blocks = append(blocks, b)
+	}
+	partition := rubberhose.NewPartition(10, blocks)
+	require.Equal(t, int64(30), partition.GetDataSize())
+	testBytes := []byte("abcdefghijklmnopqrstuvwxyz0123")
+	n, err := partition.WriteAt(testBytes, 0)
+	require.NoError(t, err)
+	require.Equal(t, 30, n)
+	for i, b := range blocks { //Every block holds the next 10 bytes, none of them are lost in the header
+		buf := make([]byte, 10)
+		_, err := b.ReadAt(buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, testBytes[i*10:i*10+10], buf)
+	}
+	buf := make([]byte, 15)
+	n, err = partition.ReadAt(buf, 8)
+	require.NoError(t, err)
+	require.Equal(t, 15, n)
+	require.Equal(t, testBytes[8:23], buf)
+
+	disk, _ := createTestDisk(t, rubberhose.MinBlockSize+10, 10)
+	p, err := disk.WritePartition("test", 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), p.GetDataSize())
+	_, err = p.WriteAt(testBytes, 0)
+	require.NoError(t, err)
+	other, err := rubberhose.NewDiskFromStorage(disk.Storage).GetPartition("test")
+	require.NoError(t, err)
+	buf = make([]byte, 30)
+	_, err = other.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, testBytes, buf)
+}
@@ -0,0 +1,221 @@
+package rubberhose
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// A Pool groups multiple disks so that a single partition can span all of them.
+// Every disk of the pool has to be present to open a partition created on it.
+type Pool struct {
+	Disks      []*Disk
+	Partitions map[string]*Partition
+}
+
+func NewPool(disks ...*Disk) (*Pool, error) {
+	p := &Pool{Partitions: map[string]*Partition{}}
+	for _, d := range disks {
+		if err := p.AddDisk(d); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// AddDisk attaches another disk to the pool. Partitions of the pool can grow onto it using Resize.
+// If another disk of the pool has the same id, d is assigned a new one. This breaks partitions of other pools
+// d is already part of, so a disk should only ever be used in one pool.
+func (p *Pool) AddDisk(d *Disk) error {
+	id, err := d.GetID()
+	if err != nil {
+		return err
+	}
+	blockSize, err := d.GetBlockSize()
+	if err != nil {
+		return err
+	}
+	used := map[uint16]bool{0: true, maxDiskID: true}
+	for _, other := range p.Disks {
+		if other == d {
+			return errors.New("disk already in pool")
+		}
+		otherID, err := other.GetID()
+		if err != nil {
+			return err
+		}
+		used[otherID] = true
+		otherBlockSize, err := other.GetBlockSize()
+		if err != nil {
+			return err
+		}
+		if otherBlockSize != blockSize {
+			return fmt.Errorf("block size %d differs from the pool's block size %d", blockSize, otherBlockSize)
+		}
+	}
+	if used[id] {
+		if d.readOnly {
+			return fmt.Errorf("disk id %d already used by another disk in the pool, the disk needs to be writable to get a new one", id)
+		}
+		newID, err := randomDiskID(used)
+		if err != nil {
+			return err
+		}
+		if err := d.setID(newID); err != nil {
+			return err
+		}
+	}
+	p.Disks = append(p.Disks, d)
+	for _, par := range p.Partitions {
+		key, err := d.getKey(par.password)
+		if err != nil {
+			return err
+		}
+		par.keys[d] = key
+	}
+	return nil
+}
+
+// randomDiskID returns a random disk id that isn't used yet.
+func randomDiskID(used map[uint16]bool) (uint16, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(maxDiskID+1))
+		if err != nil {
+			return 0, err
+		}
+		if id := uint16(n.Int64()); !used[id] {
+			return id, nil
+		}
+	}
+}
+
+func (p *Pool) getKeys(password string) (map[*Disk][]byte, error) {
+	keys := make(map[*Disk][]byte, len(p.Disks))
+	for _, d := range p.Disks {
+		key, err := d.getKey(password)
+		if err != nil {
+			return nil, err
+		}
+		keys[d] = key
+	}
+	return keys, nil
+}
+
+func (p *Pool) newPartition(password string, keys map[*Disk][]byte, blocks []*Block) (*Partition, error) {
+	if len(p.Disks) == 0 {
+		return nil, errors.New("empty pool")
+	}
+	d := p.Disks[0]
+	par, err := d.newPartition(keys[d], blocks)
+	if err != nil {
+		return nil, err
+	}
+	par.pool = p
+	par.keys = keys
+	par.password = password
+	return par, nil
+}
+
+func (p *Pool) GetPartition(password string) (*Partition, error) {
+	if par, ok := p.Partitions[password]; ok {
+		return par, nil
+	}
+	keys, err := p.getKeys(password)
+	if err != nil {
+		return nil, err
+	}
+	var blocks, pending []*Block
+	var metadata *Partition
+	for _, d := range p.Disks {
+		mkey := metadataKey(keys[d])
+		found, err := d.scanBlocks(keys[d], pendingKey(keys[d]), mkey, pendingKey(mkey))
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, found[0]...)
+		pending = append(pending, found[1]...)
+		if len(found[3]) > 0 {
+			found[2], err = recoverChain(found[2], found[3], func(*Disk) []byte { return mkey })
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(found[2]) > 0 { //Stored on the disk that was first in the pool when it was created
+			metadata = d.metadataFromBlocks(keys[d], found[2])
+		}
+	}
+	if len(pending) > 0 {
+		blocks, err = recoverChain(blocks, pending, func(d *Disk) []byte { return keys[d] })
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, ErrNoPartition
+	}
+	par, err := p.newPartition(password, keys, blocks)
+	if err != nil {
+		return nil, err
+	}
+	err = par.orderBlocks()
+	par.metadata = metadata
+	p.Partitions[password] = par
+	return par, err
+}
+
+func (p *Pool) WritePartition(password string, blockCount int64) (*Partition, error) {
+	if par, ok := p.Partitions[password]; ok {
+		return par, nil
+	}
+	if blockCount < 1 {
+		return nil, errors.New("a partition needs at least one block")
+	}
+	for _, d := range p.Disks {
+		if d.readOnly {
+			return nil, ErrReadOnly
+		}
+	}
+	keys, err := p.getKeys(password)
+	if err != nil {
+		return nil, err
+	}
+	par, err := p.newPartition(password, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := par.Resize(int(blockCount)); err != nil {
+		return nil, err
+	}
+	p.Partitions[password] = par
+	return par, nil
+}
+
+// allocateBlock picks a free block across all disks of the pool, every free block being equally likely.
+func (p *Pool) allocateBlock(keys map[*Disk][]byte) (*Block, error) {
+	var total int64
+	free := make([]int64, len(p.Disks))
+	for i, d := range p.Disks {
+		f, err := d.getFreeBlockCount()
+		if err != nil {
+			return nil, err
+		}
+		free[i] = f
+		total += f
+	}
+	if total <= 0 {
+		return nil, ErrAllBlocksAllocated
+	}
+	r, err := rand.Int(rand.Reader, big.NewInt(total))
+	if err != nil {
+		return nil, err
+	}
+	n := r.Int64()
+	for i, d := range p.Disks {
+		if n < free[i] {
+			return d.allocateBlock(keys[d])
+		}
+		n -= free[i]
+	}
+	return nil, ErrAllBlocksAllocated
+}
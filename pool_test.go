@@ -0,0 +1,91 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	var storages []rubberhose.Storage
+	var disks []*rubberhose.Disk
+	for i := 0; i < 3; i++ {
+		s := rubberhose.NewMemoryStorage(0)
+		d := rubberhose.NewDiskFromStorage(s)
+		err := d.Write(rubberhose.MinBlockSize+10, 4)
+		require.NoError(t, err)
+		storages = append(storages, s)
+		disks = append(disks, d)
+	}
+	pool, err := rubberhose.NewPool(disks[0], disks[1])
+	require.NoError(t, err)
+	testPass := "test"
+	p, err := pool.WritePartition(testPass, 7)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("0123456789"), 7)
+	n, err := p.WriteAt(testBytes, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(testBytes), n)
+	require.NoError(t, pool.AddDisk(disks[2]))
+	require.NoError(t, p.Resize(10))
+	require.NoError(t, p.Close())
+
+	var reopened []*rubberhose.Disk
+	for i := len(storages) - 1; i >= 0; i-- {
+		reopened = append(reopened, rubberhose.NewDiskFromStorage(storages[i]))
+	}
+	pool, err = rubberhose.NewPool(reopened...)
+	require.NoError(t, err)
+	p, err = pool.GetPartition(testPass)
+	require.NoError(t, err)
+	require.Equal(t, 10, p.GetBlockCount())
+	readBytes := make([]byte, len(testBytes))
+	n, err = p.ReadAt(readBytes, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(testBytes), n)
+	require.Equal(t, testBytes, readBytes)
+}
+
+func TestPoolIDCollision(t *testing.T) {
+	var storages []rubberhose.Storage
+	var disks []*rubberhose.Disk
+	for i := 0; i < 2; i++ {
+		s := rubberhose.NewMemoryStorage(0)
+		d := rubberhose.NewDiskFromStorage(s)
+		require.NoError(t, d.Write(rubberhose.MinBlockSize+10, 4))
+		storages = append(storages, s)
+		disks = append(disks, d)
+	}
+	salt := make([]byte, 8)
+	_, err := storages[0].ReadAt(salt, 12)
+	require.NoError(t, err)
+	_, err = storages[1].WriteAt(salt, 12) //Same salt, same derived id
+	require.NoError(t, err)
+	id, err := disks[0].GetID()
+	require.NoError(t, err)
+	otherID, err := disks[1].GetID()
+	require.NoError(t, err)
+	require.Equal(t, id, otherID)
+
+	pool, err := rubberhose.NewPool(disks...)
+	require.NoError(t, err)
+	otherID, err = disks[1].GetID()
+	require.NoError(t, err)
+	require.NotEqual(t, id, otherID)
+	p, err := pool.WritePartition("test", 8)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("0123456789"), 8)
+	writeTestData(t, p, testBytes, 0)
+
+	reopened := rubberhose.NewDiskFromStorage(storages[1])
+	storedID, err := reopened.GetID()
+	require.NoError(t, err)
+	require.Equal(t, otherID, storedID)
+	pool, err = rubberhose.NewPool(rubberhose.NewDiskFromStorage(storages[0]), reopened)
+	require.NoError(t, err)
+	p, err = pool.GetPartition("test")
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+}
@@ -7,16 +7,33 @@ type RequestID uint
 const (
 	AddRequestID RequestID = iota
 	DeleteRequestID
+	ScrubRequestID
+	InfoRequestID
+	ListRequestID
+	GrowRequestID
+	ShrinkRequestID
+	ShuffleRequestID
 )
 
 type Request struct {
-	ID   RequestID
-	Data interface{}
+	ID       RequestID
+	Data     interface{}
+	Progress bool //If set the daemon sends ProgressUpdates before the response of long requests, e.g. adding a partition
+}
+
+// ProgressUpdate reports the progress of a request, the last one has Final set and is followed by the response.
+type ProgressUpdate struct {
+	Stage       string //e.g. "Searching" or "Deleting"
+	Done, Total int64
+	Final       bool
 }
 
 type AddRequest struct {
 	DiskPath string
 	Password string
+	ReadOnly bool
+	Address  string //If set the partition is served over NBD on this address instead of being exposed as a device
+	Name     string //The NBD export name when serving over the network
 }
 
 type AddResponse struct {
@@ -33,10 +50,95 @@ type DeleteResponse struct {
 	Error string
 }
 
+type ScrubRequest struct {
+	DiskPath string
+	Password string
+	Copies   int //Number of copies of a redundant partition, 0 or 1 for a normal partition
+}
+
+type ScrubResponse struct {
+	Error         string
+	BlocksChecked int
+	Repaired      int
+	Damaged       []DamagedRange
+}
+
+type InfoRequest struct {
+	DiskPath string
+	Password string
+}
+
+type InfoResponse struct {
+	Error string
+	PartitionInfo
+}
+
+// PartitionInfo describes a partition opened by the daemon.
+type PartitionInfo struct {
+	DiskPath   string
+	DevicePath string //Empty if the partition isn't exported
+	BlockCount int
+	Size       int64
+	Metadata   *Metadata //Nil if the partition has no metadata
+}
+
+type ListRequest struct{}
+
+type ListResponse struct {
+	Error      string
+	Partitions []PartitionInfo
+}
+
+type GrowRequest struct {
+	DiskPath    string
+	ExtraBlocks int64
+}
+
+type GrowResponse struct {
+	Error      string
+	BlockCount int64
+}
+
+type ShrinkRequest struct {
+	DiskPath   string
+	BlockCount int64
+	Passwords  []string //Partitions that aren't added but have to survive
+	Force      bool     //Cut off used blocks that belong to no partition, see Disk.Shrink
+}
+
+type ShrinkResponse struct {
+	Error      string
+	BlockCount int64
+}
+
+type ShuffleRequest struct {
+	DiskPath string
+	Password string
+	Fraction float64
+}
+
+type ShuffleResponse struct {
+	Error string
+	Moved int
+}
+
 func RegisterGob() {
 	gob.Register(&Request{})
+	gob.Register(&ProgressUpdate{})
 	gob.Register(&AddRequest{})
 	gob.Register(&AddResponse{})
 	gob.Register(&DeleteRequest{})
 	gob.Register(&DeleteResponse{})
+	gob.Register(&ScrubRequest{})
+	gob.Register(&ScrubResponse{})
+	gob.Register(&InfoRequest{})
+	gob.Register(&InfoResponse{})
+	gob.Register(&ListRequest{})
+	gob.Register(&ListResponse{})
+	gob.Register(&GrowRequest{})
+	gob.Register(&GrowResponse{})
+	gob.Register(&ShrinkRequest{})
+	gob.Register(&ShrinkResponse{})
+	gob.Register(&ShuffleRequest{})
+	gob.Register(&ShuffleResponse{})
 }
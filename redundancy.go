@@ -0,0 +1,346 @@
+package rubberhose
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRedundancyDegraded is returned together with the partition if some of its copies are missing or broken.
+// RepairRedundantPartition restores them.
+var ErrRedundancyDegraded = errors.New("some copies of the partition are damaged")
+
+func (d *Disk) getCopyKeys(password string, copies int) ([][]byte, error) {
+	if copies < 1 {
+		return nil, errors.New("a partition needs at least one copy")
+	}
+	key, err := d.getKey(password)
+	if err != nil {
+		return nil, err
+	}
+	return copyKeys(key, copies), nil
+}
+
+func copyKeys(key []byte, copies int) [][]byte {
+	keys := [][]byte{key}
+	for i := 1; i < copies; i++ {
+		keys = append(keys, deriveKey(key, fmt.Sprintf("copy %d", i)))
+	}
+	return keys
+}
+
+// WriteRedundantPartition creates a partition that stores every block copies times.
+// The first copy is a regular partition; the others are chains under keys derived from the password,
+// so they are indistinguishable from random data just like the first one.
+// Every block records the number of copies, so GetPartition opens the partition with all of them.
+func (d *Disk) WriteRedundantPartition(password string, blockCount int64, copies int) (*Partition, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	if _, ok := d.Partitions[password]; ok {
+		return nil, errors.New("partition already added")
+	}
+	keys, err := d.getCopyKeys(password, copies)
+	if err != nil {
+		return nil, err
+	}
+	if copies == 1 {
+		copies = 0 //A single copy is a regular partition
+	}
+	var par *Partition
+	for _, key := range keys {
+		p, err := d.writePartition(key, blockCount, copies)
+		if err != nil {
+			return nil, err
+		}
+		if par == nil {
+			par = p
+			continue
+		}
+		if err := par.copyTo(p, 0); err != nil {
+			return nil, err
+		}
+		par.replicas = append(par.replicas, p)
+	}
+	d.Partitions[password] = par
+	return par, nil
+}
+
+// GetRedundantPartition opens a partition created by WriteRedundantPartition.
+// The copies are assembled block by block, so as long as every block is intact in one of the copies the partition
+// is returned, together with ErrRedundancyDegraded if any copy misses blocks. Until it is repaired, such a partition
+// can be read and written but not resized, deleted or moved.
+func (d *Disk) GetRedundantPartition(password string, copies int) (*Partition, error) {
+	par, _, err := d.getRedundantPartition(password, copies)
+	return par, err
+}
+
+// getRedundantPartition additionally returns the blocks of the copies that couldn't be placed.
+func (d *Disk) getRedundantPartition(password string, copies int) (*Partition, []*Block, error) {
+	keys, err := d.getCopyKeys(password, copies)
+	if err != nil {
+		return nil, nil, err
+	}
+	found, err := d.scanChains(append(keys, metadataKey(keys[0]))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	par, strays, err := d.redundantPartition(keys, found[:len(keys)])
+	if par == nil {
+		return nil, nil, err
+	}
+	par.metadata = d.metadataFromBlocks(keys[0], found[len(keys)])
+	d.Partitions[password] = par
+	return par, strays, err
+}
+
+// recordedCopies returns the number of copies stored in the blocks of a partition, 0 if it isn't redundant.
+func recordedCopies(blocks []*Block) (int, error) {
+	for _, b := range blocks {
+		if !b.tagged {
+			continue
+		}
+		_, copies, ok, err := b.readIndex()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return copies, nil
+		}
+	}
+	return 0, nil
+}
+
+// redundantPartition assembles a redundant partition from the blocks found for each of its copies.
+// Copies whose chain is broken are rebuilt from the positions stored in their blocks, positions without a block
+// whose tag checks out are left as holes (nil) that Scrub and RepairRedundantPartition fill.
+// It also returns the blocks that couldn't be placed, e.g. because their data is damaged.
+func (d *Disk) redundantPartition(keys [][]byte, found [][]*Block) (*Partition, []*Block, error) {
+	chains := make([]*Partition, len(keys))
+	var intact *Partition
+	anyBlocks := false
+	for i, key := range keys {
+		anyBlocks = anyBlocks || len(found[i]) > 0
+		p, err := d.partitionFromBlocks(key, found[i])
+		if err == nil && intact != nil && len(p.blocks) != len(intact.blocks) {
+			err = ErrInvalidBlockStructure
+		}
+		if err == nil {
+			var ok bool
+			if ok, err = p.blocks[0].checkTag(); err == nil && !ok { //A chain missing its first blocks looks complete
+				err = ErrInvalidBlockStructure
+			}
+		}
+		if err != nil {
+			continue
+		}
+		chains[i] = p
+		if intact == nil {
+			intact = p
+		}
+	}
+	if !anyBlocks {
+		return nil, nil, ErrNoPartition
+	}
+	var n int64
+	if intact != nil {
+		n = int64(len(intact.blocks))
+	}
+	var strays []*Block
+	placed := make([]map[int64]*Block, len(keys))
+	for i := range keys {
+		if chains[i] != nil {
+			continue
+		}
+		placed[i] = map[int64]*Block{}
+		for _, b := range found[i] {
+			ok := false
+			var index int64
+			if b.tagged {
+				var err error
+				if index, _, ok, err = b.readIndex(); err != nil {
+					return nil, nil, err
+				}
+			}
+			if !ok || placed[i][index] != nil || intact != nil && index >= n {
+				strays = append(strays, b)
+				continue
+			}
+			placed[i][index] = b
+			if index >= n {
+				n = index + 1
+			}
+		}
+	}
+	degraded := false
+	for i, key := range keys {
+		if chains[i] == nil {
+			degraded = true
+			p, err := d.newPartition(key, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			if intact != nil {
+				p.blockSize, p.tagged = intact.blockSize, intact.tagged
+			}
+			p.blocks = make([]*Block, n)
+			for index, b := range placed[i] {
+				b.index = index
+				p.blocks[index] = b
+			}
+			chains[i] = p
+		}
+		if len(keys) > 1 {
+			chains[i].copies = len(keys)
+		}
+		for _, b := range chains[i].blocks {
+			if b != nil {
+				b.copies = chains[i].copies
+			}
+		}
+	}
+	if n == 0 {
+		return nil, nil, ErrInvalidBlockStructure
+	}
+	for i := range chains[0].blocks {
+		if !hasBlock(chains, i) {
+			return nil, nil, ErrInvalidBlockStructure
+		}
+	}
+	par := chains[0]
+	par.replicas = chains[1:]
+	if degraded {
+		return par, strays, ErrRedundancyDegraded
+	}
+	return par, strays, nil
+}
+
+// hasBlock reports whether any of the chains holds the i-th block.
+func hasBlock(chains []*Partition, i int) bool {
+	for _, p := range chains {
+		if p.blocks[i] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCopies returns ErrRedundancyDegraded if a copy of the partition misses blocks.
+// Changing the chains of the partition needs all of them.
+func (par *Partition) checkCopies() error {
+	for _, chain := range par.chains() {
+		for _, b := range chain.blocks {
+			if b == nil {
+				return ErrRedundancyDegraded
+			}
+		}
+	}
+	return nil
+}
+
+// RepairRedundantPartition re-establishes all copies of a partition.
+// Missing blocks and blocks that fail validation are replaced with newly allocated blocks and refilled from an intact
+// copy, blocks whose data doesn't match their tag are refilled in place and broken links are rewritten.
+// Blocks of the copies that couldn't be placed are wiped.
+func (d *Disk) RepairRedundantPartition(password string, copies int) (*Partition, error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	par, strays, err := d.getRedundantPartition(password, copies)
+	if err != nil && err != ErrRedundancyDegraded {
+		return nil, err
+	}
+	if err := par.repairBlocks(); err != nil {
+		return nil, err
+	}
+	for _, b := range strays {
+		if err := b.Delete(); err != nil {
+			return nil, err
+		}
+	}
+	return par, par.Sync()
+}
+
+// sourceBlock returns the first copy of the i-th block that is still intact.
+func (par *Partition) sourceBlock(i int) (*Block, error) {
+	for _, p := range append([]*Partition{par}, par.replicas...) {
+		if p.blocks[i] == nil {
+			continue
+		}
+		intact, err := p.blocks[i].intact()
+		if err != nil {
+			return nil, err
+		}
+		if intact {
+			return p.blocks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("block %d is damaged in every copy", i)
+}
+
+// replaceBlock moves the i-th block to a newly allocated one and relinks the chain, it also fills holes.
+// The old location is left alone as it might belong to another partition by now.
+func (par *Partition) replaceBlock(i int) error {
+	b, err := par.allocateBlock()
+	if err != nil {
+		return err
+	}
+	if err := b.writeIndex(int64(i)); err != nil {
+		return err
+	}
+	par.blocks[i] = b
+	if err := par.writeBlockHeader(i); err != nil {
+		return err
+	}
+	if i > 0 && par.blocks[i-1] != nil {
+		return par.writeBlockHeader(i - 1)
+	}
+	return nil
+}
+
+// repairBlocks replaces every damaged or missing block of the partition and its replicas with a copy of an intact one
+// and rewrites the links that don't point to the successor.
+func (par *Partition) repairBlocks() error {
+	buf := make([]byte, par.blockSize)
+	for i := range par.blocks {
+		src, err := par.sourceBlock(i)
+		if err != nil {
+			return err
+		}
+		if _, err := src.ReadAt(buf, 0); err != nil {
+			return err
+		}
+		for _, p := range append([]*Partition{par}, par.replicas...) {
+			intact, err := p.checkBlock(i)
+			if err != nil {
+				return err
+			}
+			if intact {
+				continue
+			}
+			if err := p.restoreBlock(i, buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyTo copies the data of every block starting at the given one into dst, which needs to have the same size.
+func (par *Partition) copyTo(dst *Partition, from int) error {
+	if len(par.blocks) != len(dst.blocks) || par.blockSize != dst.blockSize {
+		return errors.New("partitions differ in size")
+	}
+	buf := make([]byte, par.blockSize)
+	for i := from; i < len(par.blocks); i++ {
+		if _, err := par.readBlock(i, buf, 0); err != nil {
+			return err
+		}
+		if dst.blocks[i] == nil {
+			continue
+		}
+		if _, err := dst.blocks[i].WriteAt(buf, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedundantPartition(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 20)
+	testPass := "test"
+	p, err := d.WriteRedundantPartition(testPass, 4, 3)
+	require.NoError(t, err)
+	testBytes := []byte("Survives being overwritten")
+	writeTestData(t, p, testBytes, 0)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, rubberhose.DamageBlock(p, 0, i))
+	}
+	require.NoError(t, p.Close())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetRedundantPartition(testPass, 3)
+	require.Equal(t, rubberhose.ErrRedundancyDegraded, err)
+	requireData(t, p, testBytes, 0)
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	_, err = d.RepairRedundantPartition(testPass, 3)
+	require.NoError(t, err)
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	_, err = d.GetRedundantPartition(testPass, 3)
+	require.NoError(t, err)
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition(testPass) //The number of copies is stored in the blocks
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, rubberhose.DamageBlock(p, 1, i))
+		require.NoError(t, rubberhose.DamageBlock(p, 2, i))
+	}
+	requireData(t, p, testBytes, 0)
+}
+
+func TestRedundantPartitionBlockwise(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 20)
+	testPass := "test"
+	p, err := d.WriteRedundantPartition(testPass, 4, 3)
+	require.NoError(t, err)
+	_, err = p.WriteAt([]byte("Every copy lost a block"), 0)
+	require.NoError(t, err)
+	for copy, i := range []int{1, 3, 0} { //No copy is intact on its own
+		require.NoError(t, rubberhose.DamageBlock(p, copy, i))
+	}
+	require.NoError(t, p.Close())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition(testPass)
+	require.Equal(t, rubberhose.ErrRedundancyDegraded, err)
+	require.Equal(t, 4, p.GetBlockCount())
+	require.Equal(t, rubberhose.ErrRedundancyDegraded, p.Resize(5))
+	testBytes := []byte("Written while degraded, still readable")
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, p.Close())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	_, err = d.RepairRedundantPartition(testPass, 3)
+	require.NoError(t, err)
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetPartition(testPass)
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+	result, err := p.Scrub() //Every copy is complete again
+	require.NoError(t, err)
+	require.Equal(t, 12, result.BlocksChecked)
+	require.Zero(t, result.Repaired)
+	require.Empty(t, result.Damaged)
+
+	require.NoError(t, rubberhose.DamageBlock(p, 0, 2))
+	require.NoError(t, rubberhose.DamageBlock(p, 1, 2))
+	require.NoError(t, rubberhose.DamageBlock(p, 2, 2))
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	_, err = d.GetPartition(testPass)
+	require.Equal(t, rubberhose.ErrInvalidBlockStructure, err)
+}
+
+func TestRedundantPartitionCorruptData(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 20)
+	testPass := "test"
+	p, err := d.WriteRedundantPartition(testPass, 4, 3)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("0123456789"), 4)
+	writeTestData(t, p, testBytes, 0)
+	for i := 1; i < 4; i++ {
+		require.NoError(t, rubberhose.CorruptData(p, i%3, i)) //The headers stay valid, only the tags tell the copies apart
+	}
+	require.NoError(t, p.Close())
+
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetRedundantPartition(testPass, 3)
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+}
@@ -0,0 +1,124 @@
+package rubberhose
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3ObjectStore stores objects in a bucket of an S3-compatible service like AWS S3 or MinIO.
+// Requests use path-style addressing and are signed with AWS Signature Version 4.
+type S3ObjectStore struct {
+	Endpoint  string //e.g. "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000"
+	Bucket    string
+	Prefix    string //Prepended to the object names, e.g. "disks/laptop/"
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client //Nil means http.DefaultClient
+}
+
+func (s *S3ObjectStore) Get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	if err := s.checkStatus(resp, name); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3ObjectStore) Put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s.checkStatus(resp, name)
+}
+
+func (s *S3ObjectStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return s.checkStatus(resp, name)
+}
+
+func (s *S3ObjectStore) checkStatus(resp *http.Response, name string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: %s %s", resp.Request.Method, name, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *S3ObjectStore) do(method, name string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	u.Path += s.Bucket + "/" + s.Prefix + name
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds the headers of AWS Signature Version 4 to the request.
+func (s *S3ObjectStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + hex.EncodeToString(payloadHash[:]),
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
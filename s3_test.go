@@ -0,0 +1,80 @@
+package rubberhose_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 implements the object requests of S3 with a map.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+		r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(sum[:]) {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodPut:
+		f.objects[r.URL.Path] = body
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := &rubberhose.S3ObjectStore{Endpoint: server.URL, Bucket: "bucket", Prefix: "disk/", Region: "us-east-1", AccessKey: "key", SecretKey: "secret"}
+	_, err := store.Get("missing")
+	require.Equal(t, rubberhose.ErrObjectNotFound, err)
+	require.NoError(t, store.Put("object", []byte("data")))
+	require.Equal(t, []byte("data"), fake.objects["/bucket/disk/object"])
+	data, err := store.Get("object")
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), data)
+	require.NoError(t, store.Delete("object"))
+	require.Empty(t, fake.objects)
+
+	d := rubberhose.NewDiskFromStorage(rubberhose.NewObjectStorage(store))
+	require.NoError(t, d.Write(rubberhose.MinBlockSize+10, 4))
+	_, err = d.WritePartition("test", 2)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+	d = rubberhose.NewDiskFromStorage(rubberhose.NewObjectStorage(store))
+	p, err := d.GetPartition("test")
+	require.NoError(t, err)
+	require.Equal(t, 2, p.GetBlockCount())
+
+	store.AccessKey = "wrong"
+	require.Error(t, store.Put("object", nil))
+}
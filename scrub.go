@@ -0,0 +1,135 @@
+package rubberhose
+
+import "bytes"
+
+// DamagedRange is a range of the partition's data that couldn't be read from any copy.
+type DamagedRange struct {
+	Offset int64
+	Length int64
+}
+
+type ScrubResult struct {
+	BlocksChecked int
+	Repaired      int //Blocks restored from another copy
+	Damaged       []DamagedRange
+}
+
+// Scrub checks every block of the partition and its replicas.
+// A block is damaged if it fails validation, doesn't point to its successor or its data doesn't match its tag.
+// Damaged blocks are restored from an intact copy if there is one,
+// copies that differ from the first intact copy are overwritten with it.
+// Blocks of partitions created before blocks were tagged can't be checked for damaged data.
+// Scrubbing repairs blocks, so it isn't possible on read-only partitions.
+func (par *Partition) Scrub() (*ScrubResult, error) {
+	if par.IsReadOnly() {
+		return nil, ErrReadOnly
+	}
+	par.mu.Lock()
+	defer par.mu.Unlock()
+	if err := par.flushCache(); err != nil {
+		return nil, err
+	}
+	result := &ScrubResult{}
+	copies := append([]*Partition{par}, par.replicas...)
+	buf := make([]byte, par.blockSize)
+	other := make([]byte, par.blockSize)
+	for i := range par.blocks {
+		result.BlocksChecked += len(copies)
+		var src *Block
+		var broken []*Partition
+		for _, p := range copies {
+			intact, err := p.checkBlock(i)
+			if err != nil {
+				return nil, err
+			}
+			if !intact {
+				broken = append(broken, p)
+				continue
+			}
+			if src == nil {
+				src = p.blocks[i]
+			}
+		}
+		if src == nil {
+			result.addDamage(int64(i)*par.blockSize, par.blockSize)
+			continue
+		}
+		if _, err := src.ReadAt(buf, 0); err != nil {
+			return nil, err
+		}
+		for _, p := range copies {
+			if p.blocks[i] == src || containsPartition(broken, p) {
+				continue
+			}
+			if _, err := p.blocks[i].ReadAt(other, 0); err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(buf, other) {
+				broken = append(broken, p)
+			}
+		}
+		for _, p := range broken {
+			if err := p.restoreBlock(i, buf); err != nil {
+				return nil, err
+			}
+			result.Repaired++
+		}
+		if len(broken) > 0 {
+			par.dropBlock(i) //The cached data may come from a damaged copy
+		}
+	}
+	return result, par.syncDisks()
+}
+
+// checkBlock reports whether the i-th block is intact and points to its successor.
+// Missing blocks aren't intact, the link to a missing successor is rewritten once it is filled.
+func (par *Partition) checkBlock(i int) (bool, error) {
+	b := par.blocks[i]
+	if b == nil {
+		return false, nil
+	}
+	if intact, err := b.intact(); !intact || err != nil {
+		return false, err
+	}
+	if i == len(par.blocks)-1 {
+		next, err := b.GetNextBlockID()
+		return next == -1, err
+	}
+	if par.blocks[i+1] == nil {
+		return true, nil
+	}
+	return b.pointsTo(par.blocks[i+1])
+}
+
+// restoreBlock writes data into the i-th block. Missing blocks and blocks that fail validation are moved to a new
+// location first.
+func (par *Partition) restoreBlock(i int, data []byte) error {
+	var err error
+	if par.blocks[i] == nil || par.blocks[i].Validate() != nil {
+		err = par.replaceBlock(i)
+	} else {
+		err = par.writeBlockHeader(i)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = par.blocks[i].WriteAt(data, 0)
+	return err
+}
+
+func (r *ScrubResult) addDamage(off, length int64) {
+	if n := len(r.Damaged); n > 0 && r.Damaged[n-1].Offset+r.Damaged[n-1].Length == off {
+		r.Damaged[n-1].Length += length
+		return
+	}
+	r.Damaged = append(r.Damaged, DamagedRange{Offset: off, Length: length})
+}
+
+func containsPartition(partitions []*Partition, par *Partition) bool {
+	for _, p := range partitions {
+		if p == par {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package rubberhose_test
+
+import (
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrub(t *testing.T) {
+	d, path := createTestDisk(t, rubberhose.MinBlockSize+10, 20)
+	testPass := "test"
+	p, err := d.WriteRedundantPartition(testPass, 4, 2)
+	require.NoError(t, err)
+	testBytes := []byte("Scrubbed and restored")
+	writeTestData(t, p, testBytes, 0)
+	result, err := p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, 8, result.BlocksChecked)
+	require.Zero(t, result.Repaired)
+	require.Empty(t, result.Damaged)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, rubberhose.DamageBlock(p, 0, i))
+	}
+	result, err = p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, 4, result.Repaired)
+	require.Empty(t, result.Damaged)
+	d, err = rubberhose.NewDisk(path)
+	require.NoError(t, err)
+	p, err = d.GetRedundantPartition(testPass, 2)
+	require.NoError(t, err)
+	requireData(t, p, testBytes, 0)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, rubberhose.DamageBlock(p, 0, i))
+		require.NoError(t, rubberhose.DamageBlock(p, 1, i))
+	}
+	result, err = p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, []rubberhose.DamagedRange{{Offset: 0, Length: 40}}, result.Damaged)
+}
+
+func TestScrubTags(t *testing.T) {
+	d, _ := createTestDisk(t, rubberhose.MinBlockSize+10, 20)
+	p, err := d.WritePartition("single", 4)
+	require.NoError(t, err)
+	testBytes := []byte("Damage is detected")
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, rubberhose.CorruptData(p, 0, 1))
+	result, err := p.Scrub()
+	require.NoError(t, err)
+	require.Zero(t, result.Repaired)
+	require.Equal(t, []rubberhose.DamagedRange{{Offset: 10, Length: 10}}, result.Damaged)
+
+	p, err = d.WriteRedundantPartition("copies", 4, 2)
+	require.NoError(t, err)
+	writeTestData(t, p, testBytes, 0)
+	require.NoError(t, rubberhose.CorruptData(p, 0, 1)) //The first copy is read first
+	requireData(t, p, testBytes, 0)
+	result, err = p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Repaired)
+	require.Empty(t, result.Damaged)
+	require.NoError(t, rubberhose.CorruptData(p, 1, 1))
+	result, err = p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Repaired)
+	require.Empty(t, result.Damaged)
+	requireData(t, p, testBytes, 0)
+
+	require.NoError(t, p.SetCache(1<<20, rubberhose.WriteBack))
+	requireData(t, p, testBytes, 0)
+	require.NoError(t, rubberhose.CorruptData(p, 1, 1))
+	result, err = p.Scrub()
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Repaired)
+	requireData(t, p, testBytes, 0)
+	stats := p.CacheStats()
+	require.Equal(t, int64(1), stats.Hits) //Only the repaired block is read again
+	require.Equal(t, int64(3), stats.Misses)
+}
@@ -0,0 +1,58 @@
+package rubberhose
+
+import (
+	"crypto/rand"
+	"errors"
+	"math"
+	"math/big"
+)
+
+// Shuffle moves the given fraction of the blocks of the partition, its metadata and its copies to random free blocks
+// so that the partition doesn't stay at the same positions forever. Each move is committed by a single block header
+// write and the old block is wiped (see moveBlock). Blocks on disks without free blocks stay where they are.
+// It returns the number of moved blocks.
+func (par *Partition) Shuffle(fraction float64) (int, error) {
+	if fraction < 0 || fraction > 1 {
+		return 0, errors.New("the fraction of blocks to move has to be between 0 and 1")
+	}
+	if par.IsReadOnly() {
+		return 0, ErrReadOnly
+	}
+	if err := par.checkCopies(); err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, chain := range par.chains() {
+		order, err := randomOrder(len(chain.blocks))
+		if err != nil {
+			return moved, err
+		}
+		n := int(math.Ceil(fraction * float64(len(chain.blocks))))
+		for _, i := range order[:n] {
+			ok, err := blockOwner{par, chain}.move(i)
+			if err != nil {
+				return moved, err
+			}
+			if ok {
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
+
+// randomOrder returns the numbers from 0 to n-1 in random order.
+func randomOrder(n int) ([]int, error) {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return nil, err
+		}
+		order[i], order[j.Int64()] = order[j.Int64()], order[i]
+	}
+	return order, nil
+}
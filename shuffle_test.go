@@ -0,0 +1,54 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShuffle(t *testing.T) {
+	blockSize := int64(rubberhose.MinBlockSize + 40)
+	s := rubberhose.NewMemoryStorage(0)
+	d := rubberhose.NewDiskFromStorage(s)
+	require.NoError(t, d.Write(blockSize, 20))
+	p, err := d.WritePartition("test", 6)
+	require.NoError(t, err)
+	m, err := rubberhose.NewMetadata("shuffled")
+	require.NoError(t, err)
+	require.NoError(t, p.SetMetadata(m))
+	testBytes := bytes.Repeat([]byte("shuffle"), 30)
+	writeTestData(t, p, testBytes, 0)
+
+	_, err = p.Shuffle(1.5)
+	require.Error(t, err)
+	moved, err := p.Shuffle(0)
+	require.NoError(t, err)
+	require.Equal(t, 0, moved)
+	moved, err = p.Shuffle(1)
+	require.NoError(t, err)
+	metadataBlocks := moved - 6
+	require.Greater(t, metadataBlocks, 0)
+	moved, err = p.Shuffle(0.5)
+	require.NoError(t, err)
+	require.Equal(t, 3+(metadataBlocks+1)/2, moved) //Half of the blocks of each chain, rounded up
+	requireData(t, p, testBytes, 0)
+
+	d = rubberhose.NewDiskFromStorage(s)
+	p, err = d.GetPartition("test")
+	require.NoError(t, err)
+	require.Equal(t, 6, p.GetBlockCount())
+	requireData(t, p, testBytes, 0)
+	m, err = p.GetMetadata()
+	require.NoError(t, err)
+	require.Equal(t, "shuffled", m.Label)
+	free := 20 - 6 - metadataBlocks
+	for i := 0; i < free; i++ { //Fill the disk so nothing can be moved
+		_, err := d.WritePartition(string(rune('a'+i)), 1)
+		require.NoError(t, err)
+	}
+	moved, err = p.Shuffle(1)
+	require.NoError(t, err)
+	require.Equal(t, 0, moved)
+}
@@ -0,0 +1,213 @@
+package rubberhose
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage holds the bytes of a disk.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Sync() error
+	Close() error
+}
+
+// ResizableStorage is implemented by storages whose size can be changed, which is needed to grow and shrink a disk.
+// Writing past the end of it grows it.
+type ResizableStorage interface {
+	Storage
+	Truncate(size int64) error
+}
+
+// OpenStorage opens the file, block device or chunk directory (see ChunkedStorage) at path with the given os.OpenFile flags.
+func OpenStorage(path string, flag int) (Storage, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return OpenChunkedStorage(path, flag)
+	}
+	f, err := os.OpenFile(path, flag, 0755)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if isBlockDevice(info) {
+		return BlockDeviceStorage{File: f}, nil
+	}
+	return FileStorage{File: f}, nil
+}
+
+// FileStorage stores a disk in a regular file.
+type FileStorage struct {
+	*os.File
+}
+
+func (s FileStorage) Size() (int64, error) {
+	info, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// BlockDeviceStorage stores a disk directly on a block device, whose size is fixed.
+type BlockDeviceStorage struct {
+	File         *os.File
+	SizeDetector SizeDetector //Nil means DefaultSizeDetector
+}
+
+func (s BlockDeviceStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.File.ReadAt(p, off)
+}
+
+func (s BlockDeviceStorage) WriteAt(p []byte, off int64) (int, error) {
+	return s.File.WriteAt(p, off)
+}
+
+func (s BlockDeviceStorage) Size() (int64, error) {
+	detector := s.SizeDetector
+	if detector == nil {
+		detector = DefaultSizeDetector
+	}
+	return detector.Size(s.File)
+}
+
+func (s BlockDeviceStorage) Sync() error {
+	return s.File.Sync()
+}
+
+func (s BlockDeviceStorage) Close() error {
+	return s.File.Close()
+}
+
+// SectionStorage stores a disk in length bytes of another storage starting at offset, e.g. at the end of a video.
+// The rest of the storage is never touched. Offsets of the disk are relative to the section,
+// so the section can be moved inside the storage or to another one.
+type SectionStorage struct {
+	Storage
+	offset int64
+	length int64
+}
+
+var errOutsideSection = errors.New("write outside of the disk's section")
+
+func NewSectionStorage(s Storage, offset, length int64) (*SectionStorage, error) {
+	if offset < 0 || length < 1 {
+		return nil, fmt.Errorf("invalid section of %d bytes at offset %d", length, offset)
+	}
+	return &SectionStorage{Storage: s, offset: offset, length: length}, nil
+}
+
+func (s *SectionStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= s.length {
+		return 0, io.EOF
+	}
+	if max := s.length - off; int64(len(p)) > max {
+		n, err := s.Storage.ReadAt(p[:max], s.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return s.Storage.ReadAt(p, s.offset+off)
+}
+
+func (s *SectionStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > s.length {
+		return 0, errOutsideSection
+	}
+	return s.Storage.WriteAt(p, s.offset+off)
+}
+
+// Size returns the length of the section, even if the storage doesn't hold all of it yet.
+func (s *SectionStorage) Size() (int64, error) {
+	return s.length, nil
+}
+
+// MemoryStorage keeps a disk in memory, it is lost once the process exits.
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewMemoryStorage returns a MemoryStorage holding size zero bytes.
+func NewMemoryStorage(size int64) *MemoryStorage {
+	return &MemoryStorage{data: make([]byte, size)}
+}
+
+func (s *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if end := off + int64(len(p)); end > int64(len(s.data)) {
+		s.resize(end)
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *MemoryStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *MemoryStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size < 0 {
+		return fmt.Errorf("negative size %d", size)
+	}
+	s.resize(size)
+	return nil
+}
+
+func (s *MemoryStorage) resize(size int64) {
+	if size <= int64(cap(s.data)) {
+		old := len(s.data)
+		s.data = s.data[:size]
+		for i := old; i < len(s.data); i++ { //Bytes cut off earlier may still be in the backing array
+			s.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, s.data)
+	s.data = data
+}
+
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Close does nothing, the data stays available so the storage can be opened again.
+func (s *MemoryStorage) Close() error {
+	return nil
+}
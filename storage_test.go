@@ -0,0 +1,103 @@
+package rubberhose_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rubberhose "github.com/Cookie04DE/RubberHose"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedStorage struct {
+	rubberhose.Storage //Hides Truncate, like a block device
+}
+
+func TestStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	file, err := rubberhose.OpenStorage(path, os.O_RDWR)
+	require.NoError(t, err)
+	require.IsType(t, rubberhose.FileStorage{}, file)
+	for _, s := range []rubberhose.ResizableStorage{rubberhose.NewMemoryStorage(0), file.(rubberhose.FileStorage)} {
+		_, err := s.WriteAt([]byte("data"), 4)
+		require.NoError(t, err)
+		size, err := s.Size()
+		require.NoError(t, err)
+		require.Equal(t, int64(8), size)
+		buf := make([]byte, 6)
+		n, err := s.ReadAt(buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, 6, n)
+		require.Equal(t, []byte("\x00\x00\x00\x00da"), buf)
+		n, err = s.ReadAt(buf, 4)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, "data", string(buf[:n]))
+		require.NoError(t, s.Truncate(5))
+		require.NoError(t, s.Truncate(8))
+		n, err = s.ReadAt(buf[:4], 4)
+		require.NoError(t, err)
+		require.Equal(t, []byte("d\x00\x00\x00"), buf[:n])
+		require.NoError(t, s.Sync())
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestFixedSizeDisk(t *testing.T) {
+	d := rubberhose.NewDiskFromStorage(fixedStorage{rubberhose.NewMemoryStorage(1560)})
+	require.False(t, d.IsBlockDevice())
+	require.NoError(t, d.WriteFull(rubberhose.MinBlockSize+10))
+	count, err := d.GetBlockCount()
+	require.NoError(t, err)
+	require.Equal(t, int64(23), count)
+	_, err = d.WritePartition("test", 23)
+	require.NoError(t, err)
+	_, err = d.WritePartition("other", 1)
+	require.Equal(t, rubberhose.ErrAllBlocksAllocated, err)
+	require.Error(t, d.Grow(1))
+	require.Error(t, d.Shrink(22, false))
+
+	d = rubberhose.NewDiskFromStorage(rubberhose.NewMemoryStorage(40))
+	require.Error(t, d.WriteFull(rubberhose.MinBlockSize+10))
+}
+
+func TestSectionStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video")
+	prefix, suffix := bytes.Repeat([]byte("video"), 200), []byte("trailer")
+	length := int64(32 + 10*(rubberhose.MinBlockSize+20))
+	require.NoError(t, os.WriteFile(path, append(append(append([]byte{}, prefix...), make([]byte, length)...), suffix...), 0600))
+	d, err := rubberhose.NewDiskInFile(path, int64(len(prefix)), length)
+	require.NoError(t, err)
+	require.NoError(t, d.WriteFull(rubberhose.MinBlockSize+20))
+	p, err := d.WritePartition("test", 6)
+	require.NoError(t, err)
+	testBytes := bytes.Repeat([]byte("hidden"), 20)
+	writeTestData(t, p, testBytes, 0)
+	_, err = d.WriteAt([]byte("x"), length)
+	require.Error(t, err)
+	require.Error(t, d.Grow(1))
+	require.NoError(t, d.Close())
+	host, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, prefix, host[:len(prefix)])
+	require.Equal(t, suffix, host[int64(len(prefix))+length:])
+
+	moved := rubberhose.NewMemoryStorage(0)
+	_, err = moved.WriteAt(host[len(prefix):int64(len(prefix))+length], 3)
+	require.NoError(t, err)
+	for _, open := range []func() (*rubberhose.Disk, error){
+		func() (*rubberhose.Disk, error) { return rubberhose.NewDiskInFile(path, int64(len(prefix)), length) },
+		func() (*rubberhose.Disk, error) { //The blocks don't depend on where the section starts
+			s, err := rubberhose.NewSectionStorage(moved, 3, length)
+			return rubberhose.NewDiskFromStorage(s), err
+		},
+	} {
+		d, err := open()
+		require.NoError(t, err)
+		p, err := d.GetPartition("test")
+		require.NoError(t, err)
+		requireData(t, p, testBytes, 0)
+	}
+}